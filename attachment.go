@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	gonanoid "github.com/matoous/go-nanoid"
+	"github.com/matryer/way"
+)
+
+const (
+	maxAttachmentsPerMessage = 10
+	// attachmentReadTimeout replaces the server ReadTimeout for uploads
+	// so they don't fail halfway on slow connections.
+	attachmentReadTimeout = time.Minute * 10
+	// unattachedAttachmentTTL is how long an upload waits
+	// to be sent in a message before it gets deleted.
+	unattachedAttachmentTTL = time.Hour * 24
+	attachmentSweepInterval = time.Hour
+)
+
+var attachmentContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	// WebP can't be decoded by the standard library
+	// so it's stored as is, without stripping its metadata.
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// Attachment model.
+// Images are processed in background: until then Processing is true,
+// and their dimensions and thumbnails are unknown.
+type Attachment struct {
+	ID          string      `json:"id"`
+	Filename    string      `json:"filename"`
+	ContentType string      `json:"contentType"`
+	Size        int64       `json:"size"`
+	URL         string      `json:"url"`
+	Width       *int        `json:"width,omitempty"`
+	Height      *int        `json:"height,omitempty"`
+	Thumbnails  []Thumbnail `json:"thumbnails,omitempty"`
+	Processing  bool        `json:"processing,omitempty"`
+	// ProcessingFailed images are not served.
+	ProcessingFailed bool      `json:"processingFailed,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
+	BlobKey          string    `json:"-"`
+	ConversationID   string    `json:"-"`
+	MessageID        *string   `json:"-"`
+}
+
+// POST /api/conversations/{conversation_id}/attachments?filename={filename}
+func uploadAttachment(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.ContentLength < 0 {
+		http.Error(w, http.StatusText(http.StatusLengthRequired), http.StatusLengthRequired)
+		return
+	}
+
+	if r.ContentLength > maxAttachmentSize {
+		http.Error(w, fmt.Sprintf("File too large. %d bytes max", maxAttachmentSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	extendReadDeadline(r, attachmentReadTimeout)
+
+	filename := filepath.Base(strings.TrimSpace(r.URL.Query().Get("filename")))
+	if filename == "." || filename == string(filepath.Separator) {
+		filename = "file"
+	}
+	if len([]rune(filename)) > 255 {
+		filename = string([]rune(filename)[:255])
+	}
+
+	// Sniff the content type instead of trusting the client.
+	body := bufio.NewReaderSize(r.Body, 512)
+	head, err := body.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(head) == 0 {
+		respond(w, Errors{map[string]string{
+			"file": "File required",
+		}}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !attachmentContentTypes[contentType] {
+		http.Error(w, "Unsupported file type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	cid := way.Param(ctx, "conversation_id")
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	isParticipant, err := queryParticipantExistance(ctx, tx, uid, cid)
+	_ = tx.Rollback()
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query participant existance: %w", err))
+		return
+	}
+
+	if !isParticipant {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	key, err := gonanoid.Nanoid()
+	if err != nil {
+		respondError(w, fmt.Errorf("could not generate blob key: %w", err))
+		return
+	}
+
+	counter := &countingReader{r: body}
+	if err = blobStore.Put(ctx, key, counter, r.ContentLength, contentType); err != nil {
+		respondError(w, fmt.Errorf("could not put blob: %w", err))
+		return
+	}
+
+	a := Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        counter.n,
+		BlobKey:     key,
+	}
+	if err = db.QueryRowContext(ctx, `
+		INSERT INTO attachments (user_id, conversation_id, blob_key, filename, content_type, size) VALUES
+			($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, uid, cid, key, a.Filename, a.ContentType, a.Size).Scan(&a.ID, &a.CreatedAt); err != nil {
+		go deleteBlobs(key)
+		respondError(w, fmt.Errorf("could not insert attachment: %w", err))
+		return
+	}
+
+	a.URL = attachmentURL(a.ID)
+
+	if processableImageTypes[contentType] {
+		a.Processing = true
+		enqueueImage(a.ID)
+	}
+
+	respond(w, a, http.StatusCreated)
+}
+
+// GET /api/attachments/{attachment_id}
+func getAttachment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	aid := way.Param(ctx, "attachment_id")
+
+	if !isID(aid) {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	var a Attachment
+	var processedAt *time.Time
+	if err := db.QueryRowContext(ctx, `
+		SELECT
+			attachments.blob_key,
+			attachments.filename,
+			attachments.content_type,
+			attachments.size,
+			attachments.processed_at,
+			attachments.processing_failed
+		FROM attachments
+		INNER JOIN participants
+			ON participants.conversation_id = attachments.conversation_id
+				AND participants.user_id = $1
+		WHERE attachments.id = $2
+	`, uid, aid).Scan(
+		&a.BlobKey,
+		&a.Filename,
+		&a.ContentType,
+		&a.Size,
+		&processedAt,
+		&a.ProcessingFailed,
+	); err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query attachment: %w", err))
+		return
+	}
+
+	// Images are not served until their metadata is stripped.
+	if processableImageTypes[a.ContentType] && processedAt == nil {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Attachment is being processed", http.StatusServiceUnavailable)
+		return
+	}
+
+	if a.ProcessingFailed {
+		http.Error(w, "Image could not be processed", http.StatusGone)
+		return
+	}
+
+	serveBlob(w, r, a.BlobKey, a.ContentType, a.Size, a.Filename)
+}
+
+// GET /api/attachments/{attachment_id}/thumbnails/{size}
+func getThumbnail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	aid := way.Param(ctx, "attachment_id")
+	size := way.Param(ctx, "size")
+
+	if !isID(aid) || !isThumbnailSize(size) {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+
+	var key, contentType, filename string
+	if err := db.QueryRowContext(ctx, `
+		SELECT
+			attachment_thumbnails.blob_key,
+			attachment_thumbnails.content_type,
+			attachments.filename
+		FROM attachment_thumbnails
+		INNER JOIN attachments ON attachment_thumbnails.attachment_id = attachments.id
+		INNER JOIN participants
+			ON participants.conversation_id = attachments.conversation_id
+				AND participants.user_id = $1
+		WHERE attachment_thumbnails.attachment_id = $2
+			AND attachment_thumbnails.size = $3
+	`, uid, aid, size).Scan(&key, &contentType, &filename); err == sql.ErrNoRows {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query thumbnail: %w", err))
+		return
+	}
+
+	serveBlob(w, r, key, contentType, 0, filename)
+}
+
+// serveBlob writes the blob with headers safe to display user uploaded content.
+// Content-Length is omitted if size is unknown (zero).
+func serveBlob(w http.ResponseWriter, r *http.Request, key, contentType string, size int64, filename string) {
+	blob, err := blobStore.Get(r.Context(), key)
+	if err == errBlobNotFound {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not get blob: %w", err))
+		return
+	}
+
+	defer blob.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") || contentType == "application/pdf" {
+		disposition = "inline"
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	if size > 0 {
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	h.Set("Cache-Control", "private, max-age=31536000, immutable")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+
+	if _, err = io.Copy(w, blob); err != nil {
+		log.Printf("could not write blob: %v\n", err)
+	}
+}
+
+// attachToMessage links attachments uploaded by the user to the conversation
+// into the given message. It returns false if any of them is not available.
+func attachToMessage(ctx context.Context, tx *sql.Tx, uid, cid, mid string, aids []string) (bool, error) {
+	if len(aids) == 0 {
+		return true, nil
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE attachments SET message_id = $1
+		WHERE id = ANY($2)
+			AND user_id = $3
+			AND conversation_id = $4
+			AND message_id IS NULL
+	`, mid, aids, uid, cid)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == int64(len(aids)), nil
+}
+
+// queryAttachments returns the attachments of each of the given messages
+// keyed by message ID.
+func queryAttachments(ctx context.Context, querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}, mids ...string) (map[string][]Attachment, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	out := make(map[string][]Attachment, len(mids))
+	if len(mids) == 0 {
+		return out, nil
+	}
+
+	rows, err := querier.QueryContext(ctx, `
+		SELECT
+			message_id,
+			id,
+			blob_key,
+			filename,
+			content_type,
+			size,
+			width,
+			height,
+			processed_at IS NULL,
+			processing_failed,
+			created_at
+		FROM attachments
+		WHERE message_id = ANY($1)
+		ORDER BY id
+	`, mids)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var aids []string
+	for rows.Next() {
+		var mid string
+		var a Attachment
+		var unprocessed bool
+		if err = rows.Scan(
+			&mid,
+			&a.ID,
+			&a.BlobKey,
+			&a.Filename,
+			&a.ContentType,
+			&a.Size,
+			&a.Width,
+			&a.Height,
+			&unprocessed,
+			&a.ProcessingFailed,
+			&a.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		a.URL = attachmentURL(a.ID)
+		a.Processing = unprocessed && processableImageTypes[a.ContentType]
+		out[mid] = append(out[mid], a)
+		aids = append(aids, a.ID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(aids) == 0 {
+		return out, nil
+	}
+
+	thumbnails, err := queryThumbnails(ctx, querier, aids...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query thumbnails: %w", err)
+	}
+
+	for mid, aa := range out {
+		for i, a := range aa {
+			out[mid][i].Thumbnails = thumbnails[a.ID]
+		}
+	}
+
+	return out, nil
+}
+
+// queryThumbnails returns the thumbnails of each of the given attachments
+// keyed by attachment ID.
+func queryThumbnails(ctx context.Context, querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}, aids ...string) (map[string][]Thumbnail, error) {
+	rows, err := querier.QueryContext(ctx, `
+		SELECT attachment_id, size, width, height, content_type, blob_key
+		FROM attachment_thumbnails
+		WHERE attachment_id = ANY($1)
+		ORDER BY size
+	`, aids)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	out := make(map[string][]Thumbnail, len(aids))
+	for rows.Next() {
+		var aid string
+		var t Thumbnail
+		if err = rows.Scan(&aid, &t.Size, &t.Width, &t.Height, &t.ContentType, &t.BlobKey); err != nil {
+			return nil, err
+		}
+
+		t.URL = thumbnailURL(aid, t.Size)
+		out[aid] = append(out[aid], t)
+	}
+
+	return out, rows.Err()
+}
+
+// deleteAttachments removes the attachments of a message
+// and returns their blob keys so they can be deleted once the transaction commits.
+func deleteAttachments(ctx context.Context, tx *sql.Tx, mid string) ([]string, error) {
+	return deleteAttachmentsWhere(ctx, tx, "message_id = $1", mid)
+}
+
+// deleteAttachmentsWhere removes the attachments matching the condition
+// along with their thumbnails and returns all their blob keys.
+func deleteAttachmentsWhere(ctx context.Context, tx *sql.Tx, cond string, args ...interface{}) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM attachment_thumbnails
+		WHERE attachment_id IN (SELECT id FROM attachments WHERE `+cond+`)
+		RETURNING blob_key
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		DELETE FROM attachments WHERE `+cond+`
+		RETURNING blob_key
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// startAttachmentSweeper periodically deletes the attachments
+// that were uploaded but never sent in a message.
+func startAttachmentSweeper() {
+	go func() {
+		ticker := time.NewTicker(attachmentSweepInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := sweepAttachments(context.Background()); err != nil {
+				log.Printf("could not sweep unattached attachments: %v\n", err)
+			}
+		}
+	}()
+}
+
+func sweepAttachments(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin tx: %w", err)
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	keys, err := deleteAttachmentsWhere(ctx, tx,
+		"message_id IS NULL AND created_at < $1",
+		time.Now().Add(-unattachedAttachmentTTL))
+	if err != nil {
+		return fmt.Errorf("could not delete unattached attachments: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit tx to sweep attachments: %w", err)
+	}
+
+	deleteBlobs(keys...)
+	return nil
+}
+
+func attachmentURL(id string) string {
+	return "/api/attachments/" + id
+}
+
+func deleteBlobs(keys ...string) {
+	for _, key := range keys {
+		if err := blobStore.Delete(context.Background(), key); err != nil {
+			log.Printf("could not delete blob %q: %v\n", key, err)
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
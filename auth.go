@@ -6,24 +6,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/kenshaw/jwt"
-	gonanoid "github.com/matoous/go-nanoid"
 )
 
-const jwtLifetime = time.Hour * 24 * 14 // 14 days.
-
-// GithubUser data.
-type GithubUser struct {
-	ID        int     `json:"id"`
-	Login     string  `json:"login"`
-	AvatarURL *string `json:"avatar_url,omitempty"`
-}
-
 // POST /api/login
 func login(w http.ResponseWriter, r *http.Request) {
 	if origin.Hostname() != "localhost" {
@@ -58,135 +47,7 @@ func login(w http.ResponseWriter, r *http.Request) {
 
 	user.Username = in.Username
 
-	exp := time.Now().Add(jwtLifetime)
-	token, err := issueToken(user.ID, exp)
-	if err != nil {
-		respondError(w, fmt.Errorf("could not create token: %w", err))
-		return
-	}
-
-	respond(w, map[string]interface{}{
-		"authUser":  user,
-		"token":     token,
-		"expiresAt": exp,
-	}, http.StatusOK)
-}
-
-// GET /api/oauth/github
-func githubOAuthStart(w http.ResponseWriter, r *http.Request) {
-	state, err := gonanoid.Nanoid()
-	if err != nil {
-		respondError(w, fmt.Errorf("could not generte state: %w", err))
-		return
-	}
-
-	stateCookieValue, err := cookieSigner.Encode("state", state)
-	if err != nil {
-		respondError(w, fmt.Errorf("could not encode state cookie: %w", err))
-		return
-	}
-
-	http.SetCookie(w, &http.Cookie{
-		Name:     "state",
-		Value:    stateCookieValue,
-		Path:     "/api/oauth/github",
-		HttpOnly: true,
-		Secure:   r.TLS != nil,
-		SameSite: http.SameSiteLaxMode,
-	})
-	http.Redirect(w, r, githubOAuthConfig.AuthCodeURL(state), http.StatusTemporaryRedirect)
-}
-
-// GET /api/oauth/github/callback
-func githubOAuthCallback(w http.ResponseWriter, r *http.Request) {
-	stateCookie, err := r.Cookie("state")
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusTeapot), http.StatusTeapot)
-		return
-	}
-
-	http.SetCookie(w, &http.Cookie{Name: "state", Value: "", MaxAge: -1})
-
-	var state string
-	if err = cookieSigner.Decode("state", stateCookie.Value, &state); err != nil {
-		http.Error(w, http.StatusText(http.StatusTeapot), http.StatusTeapot)
-		return
-	}
-
-	q := r.URL.Query()
-
-	if state != q.Get("state") {
-		http.Error(w, http.StatusText(http.StatusTeapot), http.StatusTeapot)
-		return
-	}
-
-	ctx := r.Context()
-
-	t, err := githubOAuthConfig.Exchange(ctx, q.Get("code"))
-	if err != nil {
-		respondError(w, fmt.Errorf("could not fetch github token: %w", err))
-		return
-	}
-
-	client := githubOAuthConfig.Client(ctx, t)
-	resp, err := client.Get("https://api.github.com/user")
-	if err != nil {
-		respondError(w, fmt.Errorf("could not fetch github user: %w", err))
-		return
-	}
-
-	var githubUser GithubUser
-	if err = json.NewDecoder(resp.Body).Decode(&githubUser); err != nil {
-		respondError(w, fmt.Errorf("could not decode github user: %w", err))
-		return
-	}
-	defer resp.Body.Close()
-
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		respondError(w, fmt.Errorf("could not begin tx: %w", err))
-		return
-	}
-
-	var user User
-	if err = tx.QueryRow(`
-		SELECT id, username, avatar_url FROM users WHERE github_id = $1
-	`, githubUser.ID).Scan(&user.ID, &user.Username, &user.AvatarURL); err == sql.ErrNoRows {
-		if err = tx.QueryRow(`
-			INSERT INTO users (username, avatar_url, github_id) VALUES ($1, $2, $3)
-			RETURNING id
-		`, githubUser.Login, githubUser.AvatarURL, githubUser.ID).Scan(&user.ID); err != nil {
-			respondError(w, fmt.Errorf("could not insert user: %w", err))
-			return
-		}
-		user.Username = githubUser.Login
-		user.AvatarURL = githubUser.AvatarURL
-	} else if err != nil {
-		respondError(w, fmt.Errorf("could not query user by github ID: %w", err))
-		return
-	}
-
-	if err = tx.Commit(); err != nil {
-		respondError(w, fmt.Errorf("could not commit to finish github oauth: %w", err))
-		return
-	}
-
-	exp := time.Now().Add(jwtLifetime)
-	token, err := issueToken(user.ID, exp)
-	if err != nil {
-		respondError(w, fmt.Errorf("could not issue token: %w", err))
-		return
-	}
-
-	data := make(url.Values)
-	data.Set("token", token)
-	data.Set("expires_at", exp.Format(time.RFC3339Nano))
-
-	callbackURL := cloneURL(origin)
-	callbackURL.Path = "/callback"
-	callbackURL.RawQuery = data.Encode()
-
-	http.Redirect(w, r, callbackURL.String(), http.StatusTemporaryRedirect)
+	respondWithSession(w, r, user)
 }
 
 // GET /api/auth_user
@@ -206,52 +67,91 @@ func getAuthUser(w http.ResponseWriter, r *http.Request) {
 	respond(w, u, http.StatusOK)
 }
 
-// POST /api/refresh_token
-func refreshToken(w http.ResponseWriter, r *http.Request) {
-	uid := r.Context().Value(keyAuthUserID).(string)
-
-	exp := time.Now().Add(jwtLifetime)
-	token, err := issueToken(uid, exp)
-	if err != nil {
-		respondError(w, fmt.Errorf("could not issue token: %w", err))
-		return
-	}
-
-	respond(w, map[string]interface{}{
-		"token":     token,
-		"expiresAt": exp,
-	}, http.StatusOK)
-}
-
 func guard(handler http.HandlerFunc) http.HandlerFunc {
 	guarded := func(w http.ResponseWriter, r *http.Request) {
-		var token string
-		if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
-			token = a[7:]
-		} else if t := strings.TrimSpace(r.URL.Query().Get("token")); t != "" {
-			token = t
-		} else {
+		// Commands sent through an already authenticated connection,
+		// like the WebSocket, carry its user and session instead of a token.
+		if _, ok := r.Context().Value(keyAuthUserID).(string); ok {
+			guardConnCommand(w, r, handler)
+			return
+		}
+
+		if requestToken(r) == "" {
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
 
-		var claims jwt.Claims
-		if err := jwtSigner.Decode([]byte(token), &claims); err != nil {
+		uid, sid, err := authenticate(r)
+		if err != nil {
+			respondError(w, fmt.Errorf("could not authenticate: %w", err))
+			return
+		}
+
+		if uid == "" {
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
 
 		ctx := r.Context()
-		ctx = context.WithValue(ctx, keyAuthUserID, claims.Subject)
+		ctx = context.WithValue(ctx, keyAuthUserID, uid)
+		ctx = context.WithValue(ctx, keyAuthSessionID, sid)
 
 		handler(w, r.WithContext(ctx))
 	}
 	return guarded
 }
 
-func issueToken(subject string, exp time.Time) (string, error) {
+// guardConnCommand only checks the session is still active
+// since the token of the connection may have expired since.
+func guardConnCommand(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	sid, _ := ctx.Value(keyAuthSessionID).(string)
+
+	active, err := querySessionActive(ctx, uid, sid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query session: %w", err))
+		return
+	}
+
+	if !active {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	handler(w, r)
+}
+
+// authenticate returns the user and session of the request token.
+// Both are empty if the token is invalid or its session got revoked.
+func authenticate(r *http.Request) (uid, sid string, err error) {
+	var claims jwt.Claims
+	if err := jwtSigner.Decode([]byte(requestToken(r)), &claims); err != nil || claims.JwtID == "" {
+		return "", "", nil
+	}
+
+	active, err := querySessionActive(r.Context(), claims.Subject, claims.JwtID)
+	if err != nil || !active {
+		return "", "", err
+	}
+
+	return claims.Subject, claims.JwtID, nil
+}
+
+// requestToken returns the auth token the request came with.
+func requestToken(r *http.Request) string {
+	if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+		return a[7:]
+	}
+	return strings.TrimSpace(r.URL.Query().Get("token"))
+}
+
+// issueToken creates an access token.
+// Its ID is the session it belongs to.
+func issueToken(subject, sid string, exp time.Time) (string, error) {
 	token, err := jwtSigner.Encode(jwt.Claims{
 		Subject:    subject,
+		JwtID:      sid,
 		Expiration: json.Number(strconv.FormatInt(exp.Unix(), 10)),
 	})
 	if err != nil {
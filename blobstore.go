@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore to save uploaded files.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// FSBlobStore saves blobs inside a directory of the local filesystem.
+type FSBlobStore struct {
+	Dir string
+}
+
+// Put writes the blob to a temporary file and then moves it into place
+// so readers never see partial writes.
+func (s FSBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(s.Dir, 0755); err != nil {
+		return fmt.Errorf("could not create blobs dir: %w", err)
+	}
+
+	f, err := ioutil.TempFile(s.Dir, ".upload-*")
+	if err != nil {
+		return fmt.Errorf("could not create temp file: %w", err)
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write blob: %w", err)
+	}
+
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("could not close blob file: %w", err)
+	}
+
+	if err = os.Rename(f.Name(), name); err != nil {
+		return fmt.Errorf("could not move blob into place: %w", err)
+	}
+
+	return nil
+}
+
+// Get opens the blob file.
+func (s FSBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+
+	return f, err
+}
+
+// Delete removes the blob file.
+func (s FSBlobStore) Delete(ctx context.Context, key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s FSBlobStore) path(key string) (string, error) {
+	if key == "" || key != filepath.Base(key) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+
+	return filepath.Join(s.Dir, key), nil
+}
+
+// S3BlobStore saves blobs in a bucket of an S3 compatible service like MinIO.
+// Requests use path-style URLs and are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	Endpoint        *url.URL
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Client          *http.Client
+}
+
+// Put uploads the blob.
+// The payload is not signed so it can be streamed.
+func (s S3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, r)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+	return nil
+}
+
+// Get downloads the blob.
+func (s S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Delete removes the blob.
+func (s S3BlobStore) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req)
+	if err != nil && err != errBlobNotFound {
+		return err
+	}
+
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (s S3BlobStore) newRequest(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	if key == "" {
+		return nil, errors.New("blob key required")
+	}
+
+	u := cloneURL(s.Endpoint)
+	u.Path = "/" + s.Bucket + "/" + key
+	u.RawPath = "/" + s3Escape(s.Bucket) + "/" + s3Escape(key)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("could not create s3 request: %w", err)
+	}
+
+	return req.WithContext(ctx), nil
+}
+
+func (s S3BlobStore) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not do s3 request: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errBlobNotFound
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, b)
+	}
+
+	return resp, nil
+}
+
+func (s S3BlobStore) sign(req *http.Request, now time.Time) {
+	// The payload is not signed so it can be streamed.
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, now, s.AccessKeyID, s.SecretAccessKey, s.Region, "s3", payloadHash)
+}
+
+// signV4 sets the Authorization header of the request using AWS Signature Version 4.
+// The host and all the X-Amz-* headers are signed.
+func signV4(req *http.Request, now time.Time, accessKeyID, secretAccessKey, region, service, payloadHash string) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vv := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(vv, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	signature := hex.EncodeToString(hmacSHA256(signingKey(secretAccessKey, date, region, service), stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+// canonicalQuery sorts the parameters by name and then value,
+// with both fully escaped.
+func canonicalQuery(q url.Values) string {
+	var params [][2]string
+	for k, vv := range q {
+		for _, v := range vv {
+			params = append(params, [2]string{queryEscape(k), queryEscape(v)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+
+	pairs := make([]string, len(params))
+	for i, p := range params {
+		pairs[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(pairs, "&")
+}
+
+func signingKey(secretAccessKey, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// queryEscape escapes everything but unreserved characters.
+func queryEscape(s string) string {
+	return strings.ReplaceAll(s3Escape(s), "/", "%2F")
+}
+
+// s3Escape escapes everything but unreserved characters and slashes.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
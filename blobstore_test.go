@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Vectors from the AWS documentation and the Signature Version 4 test suite.
+const (
+	testAccessKeyID     = "AKIDEXAMPLE"
+	testSecretAccessKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	emptyPayloadHash    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func TestSigningKey(t *testing.T) {
+	got := hex.EncodeToString(signingKey(testSecretAccessKey, "20120215", "us-east-1", "iam"))
+	want := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+	if got != want {
+		t.Errorf("signingKey() = %s, want %s", got, want)
+	}
+}
+
+func TestSignV4(t *testing.T) {
+	now := time.Date(2015, time.August, 30, 12, 36, 0, 0, time.UTC)
+
+	tt := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{
+			name: "get-vanilla",
+			url:  "https://example.amazonaws.com/",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=host;x-amz-date, " +
+				"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name: "get-vanilla-query-order-key-case",
+			url:  "https://example.amazonaws.com/?Param1=value1&Param2=value2",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=host;x-amz-date, " +
+				"Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name: "get-vanilla-query-order-key",
+			url:  "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=host;x-amz-date, " +
+				"Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name: "get-vanilla-empty-query-key",
+			url:  "https://example.amazonaws.com/?Param1=value1",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=host;x-amz-date, " +
+				"Signature=a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signV4(req, now, testAccessKeyID, testSecretAccessKey, "us-east-1", "service", emptyPayloadHash)
+
+			if got := req.Header.Get("Authorization"); got != tc.want {
+				t.Errorf("Authorization = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestS3BlobStore runs against a local MinIO, like the one from the README,
+// when S3_TEST_ENDPOINT is set. The bucket must exist.
+func TestS3BlobStore(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := S3BlobStore{
+		Endpoint:        u,
+		Region:          env("S3_TEST_REGION", "us-east-1"),
+		Bucket:          env("S3_TEST_BUCKET", "messenger"),
+		AccessKeyID:     env("S3_TEST_ACCESS_KEY_ID", "minioadmin"),
+		SecretAccessKey: env("S3_TEST_SECRET_ACCESS_KEY", "minioadmin"),
+	}
+
+	ctx := context.Background()
+	key := "test-" + strconv.FormatInt(time.Now().UnixNano(), 10) + " ünïcode.txt"
+	content := "hello, blob store"
+
+	if err = s.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = s.Delete(ctx, key)
+	})
+
+	rc, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(b); got != content {
+		t.Errorf("Get() content = %q, want %q", got, content)
+	}
+
+	if err = s.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+
+	if _, err = s.Get(ctx, key); err != errBlobNotFound {
+		t.Errorf("Get() after Delete() = %v, want %v", err, errBlobNotFound)
+	}
+
+	if err = s.Delete(ctx, key); err != nil {
+		t.Errorf("Delete() twice = %v, want nil", err)
+	}
+}
@@ -1,27 +1,40 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/matryer/way"
 )
 
+const maxConversationParticipants = 50
+
 // Conversation model.
 type Conversation struct {
-	ID                string   `json:"id"`
-	OtherParticipant  *User    `json:"otherParticipant"`
-	LastMessage       *Message `json:"lastMessage"`
-	HasUnreadMessages bool     `json:"hasUnreadMessages"`
+	ID                  string   `json:"id"`
+	Participants        []User   `json:"participants"`
+	LastMessage         *Message `json:"lastMessage"`
+	HasUnreadMessages   bool     `json:"hasUnreadMessages"`
+	UnreadMessagesCount int      `json:"unreadMessagesCount"`
+	IsAdmin             bool     `json:"isAdmin"`
+}
+
+// UnreadCount of the auth user across all conversations.
+type UnreadCount struct {
+	Messages      int `json:"messages"`
+	Conversations int `json:"conversations"`
 }
 
 // POST /api/conversations
 func createConversation(w http.ResponseWriter, r *http.Request) {
 	var in struct {
-		Username string `json:"username"`
+		Usernames []string `json:"usernames"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -29,10 +42,17 @@ func createConversation(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	in.Username = strings.TrimSpace(in.Username)
-	if in.Username == "" {
+	in.Usernames = uniqueUsernames(in.Usernames)
+	if len(in.Usernames) == 0 {
+		respond(w, Errors{map[string]string{
+			"usernames": "Usernames required",
+		}}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if len(in.Usernames) >= maxConversationParticipants {
 		respond(w, Errors{map[string]string{
-			"username": "Username required",
+			"usernames": fmt.Sprintf("Too many participants. %d max", maxConversationParticipants),
 		}}, http.StatusUnprocessableEntity)
 		return
 	}
@@ -48,42 +68,46 @@ func createConversation(w http.ResponseWriter, r *http.Request) {
 
 	defer func() { _ = tx.Rollback() }()
 
-	var otherParticipant User
-	if err := tx.QueryRow(`
-		SELECT id, avatar_url FROM users WHERE username = $1
-	`, in.Username).Scan(
-		&otherParticipant.ID,
-		&otherParticipant.AvatarURL,
-	); err == sql.ErrNoRows {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	} else if err != nil {
-		respondError(w, fmt.Errorf("could not query other participant: %w", err))
+	otherParticipants, err := queryUsersByUsername(ctx, tx, in.Usernames)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query other participants: %w", err))
 		return
 	}
 
-	otherParticipant.Username = in.Username
-
-	if otherParticipant.ID == uid {
-		http.Error(w, "Try start a conversation with someone else", http.StatusForbidden)
+	if len(otherParticipants) != len(in.Usernames) {
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	var cid string
-	if err := tx.QueryRow(`
-		SELECT conversation_id FROM participants WHERE user_id = $1
-		INTERSECT
-		SELECT conversation_id FROM participants WHERE user_id = $2
-	`, uid, otherParticipant.ID).Scan(&cid); err != nil && err != sql.ErrNoRows {
-		respondError(w, fmt.Errorf("could not query common conversation id: %w", err))
-		return
-	} else if err == nil {
-		http.Redirect(w, r, "/api/conversations/"+cid, http.StatusFound)
-		return
+	for _, u := range otherParticipants {
+		if u.ID == uid {
+			http.Error(w, "Try start a conversation with someone else", http.StatusForbidden)
+			return
+		}
+	}
+
+	// One-to-one conversations are unique per pair of users.
+	// Group conversations are always created from scratch.
+	if len(otherParticipants) == 1 {
+		var cid string
+		if err := tx.QueryRowContext(ctx, `
+			SELECT conversation_id FROM participants
+			WHERE conversation_id IN (SELECT conversation_id FROM participants WHERE user_id = $1)
+				AND conversation_id IN (SELECT conversation_id FROM participants WHERE user_id = $2)
+			GROUP BY conversation_id
+			HAVING count(*) = 2
+			LIMIT 1
+		`, uid, otherParticipants[0].ID).Scan(&cid); err != nil && err != sql.ErrNoRows {
+			respondError(w, fmt.Errorf("could not query common conversation id: %w", err))
+			return
+		} else if err == nil {
+			http.Redirect(w, r, "/api/conversations/"+cid, http.StatusFound)
+			return
+		}
 	}
 
 	var c Conversation
-	if err = tx.QueryRow(`
+	if err = tx.QueryRowContext(ctx, `
 		INSERT INTO conversations DEFAULT VALUES
 		RETURNING id
 	`).Scan(&c.ID); err != nil {
@@ -91,25 +115,72 @@ func createConversation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err = tx.Exec(`
-		INSERT INTO participants (user_id, conversation_id) VALUES
-			($1, $2),
-			($3, $2)
-	`, uid, c.ID, otherParticipant.ID); err != nil {
+	if _, err = tx.ExecContext(ctx, `
+		INSERT INTO participants (user_id, conversation_id, is_admin)
+		SELECT id, $1, id = $2 FROM users WHERE id = $2 OR username = ANY($3)
+	`, c.ID, uid, in.Usernames); err != nil {
 		respondError(w, fmt.Errorf("could not insert participants: %w", err))
 		return
 	}
 
+	authUser, err := queryUser(ctx, tx, uid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query auth user: %w", err))
+		return
+	}
+
 	if err = tx.Commit(); err != nil {
 		respondError(w, fmt.Errorf("could not commit tx to create conversation: %w", err))
 		return
 	}
 
-	c.OtherParticipant = &otherParticipant
+	c.Participants = append([]User{authUser}, otherParticipants...)
+	c.IsAdmin = true
+
+	go func(c Conversation) {
+		if err := conversationCreated(c); err != nil {
+			log.Printf("failed to do conversation created afterwork: %v\n", err)
+		}
+	}(c)
 
 	respond(w, c, http.StatusCreated)
 }
 
+func conversationCreated(c Conversation) error {
+	uids := make([]string, len(c.Participants))
+	for i, u := range c.Participants {
+		uids[i] = u.ID
+	}
+
+	// Fields that depend on the receiver are left for them to fetch.
+	c.IsAdmin = false
+	go broadcast(Event{Name: EventConversationCreated, Data: c, ReceiverIDs: uids})
+
+	return nil
+}
+
+// conversationUpdated lets the participants know the conversation changed,
+// along with the given receivers, like users that just left it.
+func conversationUpdated(cid string, receiverIDs ...string) error {
+	participants, err := queryParticipants(context.Background(), db, cid)
+	if err != nil {
+		return err
+	}
+
+	c := Conversation{ID: cid, Participants: participants[cid]}
+	if c.Participants == nil {
+		c.Participants = []User{}
+	}
+
+	for _, u := range c.Participants {
+		receiverIDs = append(receiverIDs, u.ID)
+	}
+
+	go broadcast(Event{Name: EventConversationUpdated, Data: c, ReceiverIDs: receiverIDs})
+
+	return nil
+}
+
 // GET /api/conversations?before={before}
 func getConversations(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -118,20 +189,35 @@ func getConversations(w http.ResponseWriter, r *http.Request) {
 	query := `
 		SELECT
 			conversations.id,
-			auth_user.messages_read_at < messages.created_at AS has_unread_messages,
+			auth_user.unread_messages_count,
+			auth_user.is_admin,
 			messages.id,
 			messages.content,
 			messages.created_at,
+			messages.edited_at,
 			messages.user_id = $1 AS mine,
-			other_users.id,
-			other_users.username,
-			other_users.avatar_url
+			messages.system
 		FROM conversations
-		INNER JOIN messages ON conversations.last_message_id = messages.id
-		INNER JOIN participants other_participants
-			ON other_participants.conversation_id = conversations.id
-				AND other_participants.user_id != $1
-		INNER JOIN users other_users ON other_participants.user_id = other_users.id
+		LEFT JOIN messages ON messages.id = CASE
+			-- Fallback to the previous message I didn't hide.
+			WHEN EXISTS (
+				SELECT 1 FROM hidden_messages
+				WHERE hidden_messages.user_id = $1
+					AND hidden_messages.message_id = conversations.last_message_id
+			) THEN (
+				SELECT visible.id FROM messages visible
+				WHERE visible.conversation_id = conversations.id
+					AND visible.deleted_at IS NULL
+					AND NOT EXISTS (
+						SELECT 1 FROM hidden_messages
+						WHERE hidden_messages.user_id = $1
+							AND hidden_messages.message_id = visible.id
+					)
+				ORDER BY visible.created_at DESC
+				LIMIT 1
+			)
+			ELSE conversations.last_message_id
+		END
 		INNER JOIN participants auth_user
 			ON auth_user.conversation_id = conversations.id
 				AND auth_user.user_id = $1`
@@ -143,7 +229,7 @@ func getConversations(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query += `
-		ORDER BY messages.created_at DESC
+		ORDER BY COALESCE(messages.created_at, conversations.created_at) DESC
 		LIMIT 25`
 
 	rows, err := db.QueryContext(ctx, query, args...)
@@ -156,25 +242,37 @@ func getConversations(w http.ResponseWriter, r *http.Request) {
 	cc := make([]Conversation, 0, 25)
 	for rows.Next() {
 		var c Conversation
-		var m Message
-		var u User
+		var mid, content sql.NullString
+		var createdAt sql.NullTime
+		var editedAt *time.Time
+		var mine, system sql.NullBool
 		if err = rows.Scan(
 			&c.ID,
-			&c.HasUnreadMessages,
-			&m.ID,
-			&m.Content,
-			&m.CreatedAt,
-			&m.Mine,
-			&u.ID,
-			&u.Username,
-			&u.AvatarURL,
+			&c.UnreadMessagesCount,
+			&c.IsAdmin,
+			&mid,
+			&content,
+			&createdAt,
+			&editedAt,
+			&mine,
+			&system,
 		); err != nil {
 			respondError(w, fmt.Errorf("could not scan conversation: %w", err))
 			return
 		}
 
-		c.LastMessage = &m
-		c.OtherParticipant = &u
+		c.HasUnreadMessages = c.UnreadMessagesCount > 0
+		// Conversations without messages yet have no last message.
+		if mid.Valid {
+			c.LastMessage = &Message{
+				ID:        mid.String,
+				Content:   content.String,
+				CreatedAt: createdAt.Time,
+				EditedAt:  editedAt,
+				Mine:      mine.Bool,
+				System:    system.Bool,
+			}
+		}
 		cc = append(cc, c)
 	}
 
@@ -183,6 +281,21 @@ func getConversations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	cids := make([]string, len(cc))
+	for i, c := range cc {
+		cids[i] = c.ID
+	}
+
+	participants, err := queryParticipants(ctx, db, cids...)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query conversations participants: %w", err))
+		return
+	}
+
+	for i, c := range cc {
+		cc[i].Participants = participants[c.ID]
+	}
+
 	respond(w, cc, http.StatusOK)
 }
 
@@ -193,29 +306,16 @@ func getConversation(w http.ResponseWriter, r *http.Request) {
 	cid := way.Param(ctx, "conversation_id")
 
 	var c Conversation
-	var u User
 	if err := db.QueryRowContext(ctx, `
 		SELECT
-			COALESCE(auth_user.messages_read_at < messages.created_at, false) AS has_unread_messages,
-			other_users.id,
-			other_users.username,
-			other_users.avatar_url
+			auth_user.unread_messages_count,
+			auth_user.is_admin
 		FROM conversations
-		LEFT JOIN messages ON conversations.last_message_id = messages.id
-		INNER JOIN participants other_participants
-			ON other_participants.conversation_id = conversations.id
-				AND other_participants.user_id != $1
-		INNER JOIN users other_users ON other_participants.user_id = other_users.id
 		INNER JOIN participants auth_user
 			ON auth_user.conversation_id = conversations.id
 				AND auth_user.user_id = $1
 		WHERE conversations.id = $2
-	`, uid, cid).Scan(
-		&c.HasUnreadMessages,
-		&u.ID,
-		&u.Username,
-		&u.AvatarURL,
-	); err == sql.ErrNoRows {
+	`, uid, cid).Scan(&c.UnreadMessagesCount, &c.IsAdmin); err == sql.ErrNoRows {
 		http.Error(w, "Conversation not found", http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -223,8 +323,85 @@ func getConversation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	participants, err := queryParticipants(ctx, db, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query conversation participants: %w", err))
+		return
+	}
+
 	c.ID = cid
-	c.OtherParticipant = &u
+	c.Participants = participants[cid]
+	c.HasUnreadMessages = c.UnreadMessagesCount > 0
 
 	respond(w, c, http.StatusOK)
 }
+
+// GET /api/unread_count
+func getUnreadCount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+
+	var uc UnreadCount
+	if err := db.QueryRowContext(ctx, `
+		SELECT
+			COALESCE(sum(unread_messages_count), 0)::INT,
+			count(CASE WHEN unread_messages_count > 0 THEN 1 END)
+		FROM participants
+		WHERE user_id = $1
+	`, uid).Scan(&uc.Messages, &uc.Conversations); err != nil {
+		respondError(w, fmt.Errorf("could not query unread count: %w", err))
+		return
+	}
+
+	respond(w, uc, http.StatusOK)
+}
+
+func queryUsersByUsername(ctx context.Context, querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}, usernames []string) ([]User, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	rows, err := querier.QueryContext(ctx, `
+		SELECT id, username, avatar_url FROM users
+		WHERE username = ANY($1)
+		ORDER BY username
+	`, usernames)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	uu := make([]User, 0, len(usernames))
+	for rows.Next() {
+		var u User
+		if err = rows.Scan(&u.ID, &u.Username, &u.AvatarURL); err != nil {
+			return nil, err
+		}
+
+		uu = append(uu, u)
+	}
+
+	return uu, rows.Err()
+}
+
+func uniqueUsernames(usernames []string) []string {
+	seen := make(map[string]struct{}, len(usernames))
+	out := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		username = strings.TrimSpace(username)
+		if username == "" {
+			continue
+		}
+
+		if _, ok := seen[username]; ok {
+			continue
+		}
+
+		seen[username] = struct{}{}
+		out = append(out, username)
+	}
+	return out
+}
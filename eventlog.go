@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+)
+
+// eventLogSize is how many of the latest events are kept
+// to replay them to reconnecting clients.
+const eventLogSize = 1000
+
+// events log of the latest broadcasted events.
+var events = newEventLog(eventLogSize)
+
+// eventLog is a bounded ring of events in ID order.
+// IDs are given when publishing so they are the same on every instance,
+// but they might skip some numbers.
+type eventLog struct {
+	mu     sync.Mutex
+	lastID uint64
+	ring   []Event
+	next   int
+	len    int
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{ring: make([]Event, size)}
+}
+
+// append keeps the event.
+func (l *eventLog) append(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastID = e.ID
+	l.ring[l.next] = e
+	l.next = (l.next + 1) % len(l.ring)
+	if l.len < len(l.ring) {
+		l.len++
+	}
+}
+
+// since returns the events after the given ID addressed to the user.
+// It reports false when some of those events are no longer kept.
+func (l *eventLog) since(id uint64, uid string) ([]Event, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.len == 0 || id > l.lastID {
+		return nil, false
+	}
+
+	oldestID := l.ring[(l.next-l.len+len(l.ring))%len(l.ring)].ID
+	if id+1 < oldestID {
+		return nil, false
+	}
+
+	var out []Event
+	for i := 0; i < l.len; i++ {
+		e := l.ring[(l.next-l.len+i+len(l.ring))%len(l.ring)]
+		if e.ID <= id {
+			continue
+		}
+
+		for _, receiverID := range e.ReceiverIDs {
+			if receiverID == uid {
+				out = append(out, e)
+				break
+			}
+		}
+	}
+	return out, true
+}
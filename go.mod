@@ -6,6 +6,7 @@ go 1.15
 
 require (
 	github.com/gorilla/securecookie v1.1.1
+	github.com/gorilla/websocket v1.4.2
 	github.com/jackc/pgx/v4 v4.9.0
 	github.com/joho/godotenv v1.3.0
 	github.com/kenshaw/jwt v0.2.0
@@ -6,12 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
-const keyAuthUserID = ContextKey("auth_user_id")
+const (
+	keyAuthUserID    = ContextKey("auth_user_id")
+	keyAuthSessionID = ContextKey("auth_session_id")
+	keyConn          = ContextKey("conn")
+)
 
 // ContextKey used for middleware.
 type ContextKey string
@@ -46,6 +53,32 @@ func requireJSON(handler http.HandlerFunc) http.HandlerFunc {
 	return required
 }
 
+// clientIP returns the address the request came from.
+// Forwarding headers are ignored since anyone can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// extendReadDeadline gives the handler d from now to read the request body,
+// past the server ReadTimeout.
+// It needs the connection in the context under keyConn.
+func extendReadDeadline(r *http.Request, d time.Duration) {
+	if c, ok := r.Context().Value(keyConn).(net.Conn); ok {
+		_ = c.SetReadDeadline(time.Now().Add(d))
+	}
+}
+
+// isID reports whether the path or query parameter looks like a row ID
+// so it can be rejected before reaching the database.
+func isID(s string) bool {
+	id, err := strconv.ParseInt(s, 10, 64)
+	return err == nil && id > 0
+}
+
 func respond(w http.ResponseWriter, v interface{}, statusCode int) {
 	b, err := json.Marshal(v)
 	if err != nil {
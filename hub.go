@@ -0,0 +1,190 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Policies for clients whose queue is full.
+const (
+	// SlowClientDisconnect closes the stream of the client.
+	// Server-sent events clients reconnect and replay what they missed.
+	SlowClientDisconnect = "disconnect"
+	// SlowClientDrop skips the event for that client only.
+	SlowClientDrop = "drop"
+)
+
+// clientQueueSize is how many events can be waiting
+// to be written to a single client.
+const clientQueueSize = 64
+
+// MessageClient to subscribe to realtime events.
+type MessageClient struct {
+	Events    chan Event
+	UserID    string
+	SessionID string
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Closed is done once the client got unregistered,
+// either by its transport or by the hub because it was too slow.
+func (c *MessageClient) Closed() <-chan struct{} {
+	return c.closed
+}
+
+func (c *MessageClient) close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+// Hub keeps the realtime clients of this instance by user
+// and delivers events to them without ever blocking.
+type Hub struct {
+	mu         sync.RWMutex
+	clients    map[string]map[*MessageClient]struct{}
+	slowPolicy string
+
+	delivered    uint64
+	dropped      uint64
+	disconnected uint64
+}
+
+// HubStats with the hub metrics.
+type HubStats struct {
+	Users         int    `json:"users"`
+	Clients       int    `json:"clients"`
+	QueuedEvents  int    `json:"queuedEvents"`
+	MaxQueueDepth int    `json:"maxQueueDepth"`
+	QueueSize     int    `json:"queueSize"`
+	Delivered     uint64 `json:"delivered"`
+	Dropped       uint64 `json:"dropped"`
+	Disconnected  uint64 `json:"disconnected"`
+}
+
+func newHub(slowPolicy string) *Hub {
+	return &Hub{
+		clients:    make(map[string]map[*MessageClient]struct{}),
+		slowPolicy: slowPolicy,
+	}
+}
+
+// register a new client of the user session.
+func (h *Hub) register(uid, sid string) *MessageClient {
+	c := &MessageClient{
+		Events:    make(chan Event, clientQueueSize),
+		UserID:    uid,
+		SessionID: sid,
+		closed:    make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[uid]; !ok {
+		h.clients[uid] = make(map[*MessageClient]struct{})
+	}
+	h.clients[uid][c] = struct{}{}
+	return c
+}
+
+// unregister the client and close it.
+// It's safe to call it more than once.
+func (h *Hub) unregister(c *MessageClient) {
+	h.mu.Lock()
+	if cc, ok := h.clients[c.UserID]; ok {
+		delete(cc, c)
+		if len(cc) == 0 {
+			delete(h.clients, c.UserID)
+		}
+	}
+	h.mu.Unlock()
+
+	c.close()
+}
+
+// deliver queues the event to the clients of its receivers.
+// Clients with a full queue are handled by the slow client policy.
+func (h *Hub) deliver(e Event) {
+	var slow []*MessageClient
+
+	seen := make(map[string]struct{}, len(e.ReceiverIDs))
+
+	h.mu.RLock()
+	for _, uid := range e.ReceiverIDs {
+		if _, ok := seen[uid]; ok {
+			continue
+		}
+
+		seen[uid] = struct{}{}
+		for c := range h.clients[uid] {
+			select {
+			case c.Events <- e:
+				atomic.AddUint64(&h.delivered, 1)
+			default:
+				atomic.AddUint64(&h.dropped, 1)
+				if h.slowPolicy != SlowClientDrop {
+					slow = append(slow, c)
+				}
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, c := range slow {
+		atomic.AddUint64(&h.disconnected, 1)
+		c.close()
+	}
+}
+
+// closeSessions closes the clients of the given sessions.
+func (h *Hub) closeSessions(uids, sids []string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, uid := range uids {
+		for c := range h.clients[uid] {
+			for _, sid := range sids {
+				if c.SessionID == sid {
+					c.close()
+				}
+			}
+		}
+	}
+}
+
+// closeAll closes every client, like when shutting down.
+func (h *Hub) closeAll() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, cc := range h.clients {
+		for c := range cc {
+			c.close()
+		}
+	}
+}
+
+// stats returns a snapshot of the hub metrics.
+func (h *Hub) stats() HubStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	s := HubStats{
+		Users:        len(h.clients),
+		QueueSize:    clientQueueSize,
+		Delivered:    atomic.LoadUint64(&h.delivered),
+		Dropped:      atomic.LoadUint64(&h.dropped),
+		Disconnected: atomic.LoadUint64(&h.disconnected),
+	}
+	for _, cc := range h.clients {
+		for c := range cc {
+			depth := len(c.Events)
+			s.Clients++
+			s.QueuedEvents += depth
+			if depth > s.MaxQueueDepth {
+				s.MaxQueueDepth = depth
+			}
+		}
+	}
+	return s
+}
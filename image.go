@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"time"
+
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+const (
+	maxImagePixels         = 50_000_000
+	imageProcessingTimeout = time.Minute
+)
+
+// thumbnailSizes are the max width or height of the generated thumbnails.
+var thumbnailSizes = []int{160, 480, 960}
+
+// processableImageTypes are the image content types the server
+// knows how to decode, strip and thumbnail.
+var processableImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+var imageJobs = make(chan string, 100)
+
+// errUnprocessableImage is returned when processing an image can't succeed
+// no matter how many times it's retried.
+var errUnprocessableImage = errors.New("unprocessable image")
+
+// Thumbnail of an image attachment.
+type Thumbnail struct {
+	Size        int    `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ContentType string `json:"contentType"`
+	URL         string `json:"url"`
+	BlobKey     string `json:"-"`
+}
+
+// startImageWorkers launches n goroutines processing image attachments
+// and enqueues the ones left pending from a previous run.
+func startImageWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for aid := range imageJobs {
+				ctx, cancel := context.WithTimeout(context.Background(), imageProcessingTimeout)
+				if err := processImage(ctx, aid); errors.Is(err, errUnprocessableImage) {
+					log.Printf("could not process image attachment %s: %v\n", aid, err)
+					if err := failImage(ctx, aid); err != nil {
+						log.Printf("could not mark image attachment %s as failed: %v\n", aid, err)
+					}
+				} else if err != nil {
+					log.Printf("could not process image attachment %s: %v\n", aid, err)
+				}
+				cancel()
+			}
+		}()
+	}
+
+	go func() {
+		rows, err := db.Query(`
+			SELECT id FROM attachments
+			WHERE processed_at IS NULL AND content_type = ANY($1)
+		`, processableImageContentTypes())
+		if err != nil {
+			log.Printf("could not query pending image attachments: %v\n", err)
+			return
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var aid string
+			if err = rows.Scan(&aid); err != nil {
+				log.Printf("could not scan pending image attachment: %v\n", err)
+				return
+			}
+
+			imageJobs <- aid
+		}
+
+		if err = rows.Err(); err != nil {
+			log.Printf("could not iterate over pending image attachments: %v\n", err)
+		}
+	}()
+}
+
+func enqueueImage(aid string) {
+	go func() { imageJobs <- aid }()
+}
+
+func processableImageContentTypes() []string {
+	out := make([]string, 0, len(processableImageTypes))
+	for ct := range processableImageTypes {
+		out = append(out, ct)
+	}
+	return out
+}
+
+// processImage re-encodes the image attachment without metadata,
+// generates its thumbnails and records its dimensions.
+// Once done, participants are notified if the attachment is already part of a message.
+func processImage(ctx context.Context, aid string) error {
+	var oldKey, contentType string
+	if err := db.QueryRowContext(ctx, `
+		SELECT blob_key, content_type FROM attachments
+		WHERE id = $1 AND processed_at IS NULL
+	`, aid).Scan(&oldKey, &contentType); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not query attachment: %w", err)
+	}
+
+	blob, err := blobStore.Get(ctx, oldKey)
+	if err != nil {
+		return fmt.Errorf("could not get blob: %w", err)
+	}
+
+	b, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return fmt.Errorf("could not read blob: %w", err)
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("%w: could not decode image config: %v", errUnprocessableImage, err)
+	}
+
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return fmt.Errorf("%w: image too large: %dx%d", errUnprocessableImage, cfg.Width, cfg.Height)
+	}
+
+	var stripped bytes.Buffer
+	var img image.Image
+	switch contentType {
+	case "image/jpeg":
+		if img, err = jpeg.Decode(bytes.NewReader(b)); err != nil {
+			return fmt.Errorf("%w: could not decode jpeg: %v", errUnprocessableImage, err)
+		}
+
+		img = orient(img, jpegOrientation(b))
+		err = jpeg.Encode(&stripped, img, &jpeg.Options{Quality: 90})
+	case "image/png":
+		if img, err = png.Decode(bytes.NewReader(b)); err != nil {
+			return fmt.Errorf("%w: could not decode png: %v", errUnprocessableImage, err)
+		}
+
+		err = png.Encode(&stripped, img)
+	case "image/gif":
+		var g *gif.GIF
+		if g, err = gif.DecodeAll(bytes.NewReader(b)); err != nil {
+			return fmt.Errorf("%w: could not decode gif: %v", errUnprocessableImage, err)
+		}
+
+		img = g.Image[0]
+		err = gif.EncodeAll(&stripped, g)
+	default:
+		return fmt.Errorf("%w: unsupported image type %q", errUnprocessableImage, contentType)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: could not encode stripped image: %v", errUnprocessableImage, err)
+	}
+
+	newKey, err := gonanoid.Nanoid()
+	if err != nil {
+		return fmt.Errorf("could not generate blob key: %w", err)
+	}
+
+	if err = blobStore.Put(ctx, newKey, bytes.NewReader(stripped.Bytes()), int64(stripped.Len()), contentType); err != nil {
+		return fmt.Errorf("could not put stripped image: %w", err)
+	}
+
+	newKeys := []string{newKey}
+	bounds := img.Bounds()
+	tt := make([]Thumbnail, 0, len(thumbnailSizes))
+	for _, size := range thumbnailSizes {
+		if size >= bounds.Dx() && size >= bounds.Dy() {
+			break
+		}
+
+		t, err := putThumbnail(ctx, img, size, contentType)
+		if err != nil {
+			go deleteBlobs(newKeys...)
+			return fmt.Errorf("could not create %d thumbnail: %w", size, err)
+		}
+
+		newKeys = append(newKeys, t.BlobKey)
+		tt = append(tt, t)
+	}
+
+	a := Attachment{ID: aid, ContentType: contentType}
+	if err = saveProcessedImage(ctx, &a, newKey, int64(stripped.Len()), bounds.Dx(), bounds.Dy(), tt); err != nil {
+		go deleteBlobs(newKeys...)
+		return err
+	}
+
+	go deleteBlobs(oldKey)
+
+	if a.MessageID != nil {
+		go broadcastAttachmentProcessed(a)
+	}
+
+	return nil
+}
+
+// failImage marks the image attachment as processed without success
+// so it's not retried and clients stop waiting for it.
+// Its original blob is never served since it may carry metadata.
+func failImage(ctx context.Context, aid string) error {
+	a := Attachment{ID: aid, ProcessingFailed: true}
+	if err := db.QueryRowContext(ctx, `
+		UPDATE attachments SET processing_failed = true, processed_at = now()
+		WHERE id = $1 AND processed_at IS NULL
+		RETURNING conversation_id, message_id, filename, content_type, size, created_at
+	`, aid).Scan(
+		&a.ConversationID,
+		&a.MessageID,
+		&a.Filename,
+		&a.ContentType,
+		&a.Size,
+		&a.CreatedAt,
+	); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not update attachment: %w", err)
+	}
+
+	a.URL = attachmentURL(a.ID)
+
+	if a.MessageID != nil {
+		go broadcastAttachmentProcessed(a)
+	}
+
+	return nil
+}
+
+func isThumbnailSize(s string) bool {
+	for _, size := range thumbnailSizes {
+		if s == strconv.Itoa(size) {
+			return true
+		}
+	}
+	return false
+}
+
+func putThumbnail(ctx context.Context, img image.Image, size int, contentType string) (Thumbnail, error) {
+	bounds := img.Bounds()
+	w, h := size, bounds.Dy()*size/bounds.Dx()
+	if bounds.Dy() > bounds.Dx() {
+		w, h = bounds.Dx()*size/bounds.Dy(), size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	t := Thumbnail{Size: size, Width: w, Height: h, ContentType: "image/png"}
+	thumb := resize(img, w, h)
+
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		t.ContentType = "image/jpeg"
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return t, fmt.Errorf("could not encode thumbnail: %w", err)
+	}
+
+	if t.BlobKey, err = gonanoid.Nanoid(); err != nil {
+		return t, fmt.Errorf("could not generate blob key: %w", err)
+	}
+
+	if err = blobStore.Put(ctx, t.BlobKey, bytes.NewReader(buf.Bytes()), int64(buf.Len()), t.ContentType); err != nil {
+		return t, fmt.Errorf("could not put thumbnail: %w", err)
+	}
+
+	return t, nil
+}
+
+func saveProcessedImage(ctx context.Context, a *Attachment, key string, size int64, width, height int, tt []Thumbnail) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin tx: %w", err)
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	if err = tx.QueryRowContext(ctx, `
+		UPDATE attachments SET
+			blob_key = $1,
+			size = $2,
+			width = $3,
+			height = $4,
+			processed_at = now()
+		WHERE id = $5
+		RETURNING conversation_id, message_id, filename, created_at
+	`, key, size, width, height, a.ID).Scan(
+		&a.ConversationID,
+		&a.MessageID,
+		&a.Filename,
+		&a.CreatedAt,
+	); err != nil {
+		return fmt.Errorf("could not update attachment: %w", err)
+	}
+
+	for _, t := range tt {
+		if _, err = tx.ExecContext(ctx, `
+			INSERT INTO attachment_thumbnails (attachment_id, size, width, height, content_type, blob_key) VALUES
+				($1, $2, $3, $4, $5, $6)
+		`, a.ID, t.Size, t.Width, t.Height, t.ContentType, t.BlobKey); err != nil {
+			return fmt.Errorf("could not insert thumbnail: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit tx to save processed image: %w", err)
+	}
+
+	a.BlobKey = key
+	a.Size = size
+	a.Width = &width
+	a.Height = &height
+	a.URL = attachmentURL(a.ID)
+	a.Thumbnails = tt
+	for i := range a.Thumbnails {
+		a.Thumbnails[i].URL = thumbnailURL(a.ID, a.Thumbnails[i].Size)
+	}
+
+	return nil
+}
+
+func broadcastAttachmentProcessed(a Attachment) {
+	uids, err := queryParticipantIDs(context.Background(), db, a.ConversationID)
+	if err != nil {
+		log.Printf("could not query participant ids: %v\n", err)
+		return
+	}
+
+	broadcast(Event{
+		Name: EventAttachmentProcessed,
+		Data: map[string]interface{}{
+			"conversationId": a.ConversationID,
+			"messageId":      *a.MessageID,
+			"attachment":     a,
+		},
+		ReceiverIDs: uids,
+	})
+}
+
+// resize scales the image down to the given dimensions
+// averaging the source pixels that fall into each destination pixel.
+func resize(src image.Image, w, h int) *image.RGBA {
+	sb := src.Bounds()
+	rgba := image.NewRGBA(sb)
+	draw.Draw(rgba, sb, src, sb.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw, sh := sb.Dx(), sb.Dy()
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := sy*rgba.Stride + x0*4
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(rgba.Pix[i])
+					g += uint32(rgba.Pix[i+1])
+					b += uint32(rgba.Pix[i+2])
+					a += uint32(rgba.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+
+			j := y*dst.Stride + x*4
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// orient applies the EXIF orientation to the image
+// since it is lost once the metadata gets stripped.
+func orient(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	dw, dh := sw, sh
+	if orientation >= 5 {
+		dw, dh = sh, sw
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // flip horizontal.
+				dx, dy = sw-1-x, y
+			case 3: // rotate 180.
+				dx, dy = sw-1-x, sh-1-y
+			case 4: // flip vertical.
+				dx, dy = x, sh-1-y
+			case 5: // transpose.
+				dx, dy = y, x
+			case 6: // rotate 90 clockwise.
+				dx, dy = sh-1-y, x
+			case 7: // transverse.
+				dx, dy = sh-1-y, sw-1-x
+			case 8: // rotate 90 counter clockwise.
+				dx, dy = y, sw-1-x
+			}
+			dst.Set(dx, dy, src.At(sb.Min.X+x, sb.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the orientation tag from the EXIF segment
+// of a JPEG file. It returns 1 (normal) if not found.
+func jpegOrientation(b []byte) int {
+	o, err := readJPEGOrientation(bytes.NewReader(b))
+	if err != nil {
+		return 1
+	}
+	return o
+}
+
+func readJPEGOrientation(r *bytes.Reader) (int, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return 0, errors.New("not a jpeg")
+	}
+
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return 0, err
+		}
+
+		if marker[0] != 0xFF || marker[1] == 0xDA { // start of scan.
+			return 0, errors.New("exif not found")
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return 0, err
+		}
+
+		if length < 2 {
+			return 0, errors.New("invalid segment length")
+		}
+
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return 0, err
+		}
+
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+	}
+}
+
+func tiffOrientation(tiff []byte) (int, error) {
+	if len(tiff) < 8 {
+		return 0, errors.New("tiff header too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, errors.New("invalid tiff byte order")
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return 0, errors.New("invalid ifd offset")
+	}
+
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:])), nil
+		}
+	}
+
+	return 0, errors.New("orientation not found")
+}
+
+func thumbnailURL(aid string, size int) string {
+	return fmt.Sprintf("%s/thumbnails/%d", attachmentURL(aid), size)
+}
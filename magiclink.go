@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+const (
+	// magicLinkLifetime is how long a login link works.
+	magicLinkLifetime = time.Minute * 15
+	// magicLinkMinInterval is the minimum time between
+	// two links sent to the same email.
+	magicLinkMinInterval = time.Minute
+	// maxMagicLinksPerIP is how many links a client can ask for,
+	// to any emails, within magicLinkIPWindow.
+	maxMagicLinksPerIP = 5
+	magicLinkIPWindow  = time.Minute * 15
+)
+
+// magicLink is the payload of the signed token sent by email.
+type magicLink struct {
+	ID        string
+	Email     string
+	ExpiresAt time.Time
+}
+
+var magicLinkSigner *securecookie.SecureCookie
+
+// POST /api/magic_links
+func sendMagicLink(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	email, ok := normalizeEmail(in.Email)
+	if !ok {
+		respond(w, Errors{map[string]string{
+			"email": "Invalid email",
+		}}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	retryAfter, err := allowMagicLink(r.Context(), email, clientIP(r))
+	if err != nil {
+		respondError(w, fmt.Errorf("could not rate limit magic link: %w", err))
+		return
+	}
+
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		http.Error(w, "Too many login links requested", http.StatusTooManyRequests)
+		return
+	}
+
+	id, err := gonanoid.Nanoid()
+	if err != nil {
+		respondError(w, fmt.Errorf("could not generate magic link id: %w", err))
+		return
+	}
+
+	token, err := magicLinkSigner.Encode("magic_link", magicLink{
+		ID:        id,
+		Email:     email,
+		ExpiresAt: time.Now().Add(magicLinkLifetime),
+	})
+	if err != nil {
+		respondError(w, fmt.Errorf("could not encode magic link: %w", err))
+		return
+	}
+
+	link := cloneURL(origin)
+	link.Path = "/magic-link"
+	link.RawQuery = url.Values{"token": {token}}.Encode()
+
+	// Sent in the background so the response time
+	// doesn't tell anything about the mail server.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		if err := mailer.Send(ctx, email, "Your Messenger login link", fmt.Sprintf(
+			"Hi,\n\nUse this link to log in to Messenger:\n\n%s\n\n"+
+				"It works once and expires in %d minutes.\n"+
+				"If you didn't ask for it, you can ignore this email.\n",
+			link, int(magicLinkLifetime.Minutes()),
+		)); err != nil {
+			log.Printf("failed to do send magic link afterwork: %v\n", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// POST /api/magic_link_login
+func magicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var ml magicLink
+	if err := magicLinkSigner.Decode("magic_link", in.Token, &ml); err != nil || !ml.ExpiresAt.After(time.Now()) {
+		http.Error(w, "Invalid or expired login link", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+
+	// The link is only spent if the user could be logged in.
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	var inserted bool
+	if err = tx.QueryRowContext(ctx, `
+		INSERT INTO used_magic_links (id, expires_at) VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+		RETURNING true
+	`, ml.ID, ml.ExpiresAt).Scan(&inserted); err == sql.ErrNoRows {
+		http.Error(w, "Login link already used", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not insert used magic link: %w", err))
+		return
+	}
+
+	uid, err := queryIdentityUser(ctx, tx, "email", ProviderIdentity{
+		ID:       ml.Email,
+		Username: rxSpaces.ReplaceAllString(strings.SplitN(ml.Email, "@", 2)[0], "_"),
+	})
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query email identity user: %w", err))
+		return
+	}
+
+	user, err := queryUser(ctx, tx, uid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query user: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to log in with magic link: %w", err))
+		return
+	}
+
+	go func() {
+		if _, err := db.Exec(`DELETE FROM used_magic_links WHERE expires_at < now()`); err != nil {
+			log.Printf("failed to do delete expired magic links afterwork: %v\n", err)
+		}
+	}()
+
+	respondWithSession(w, r, user)
+}
+
+// normalizeEmail parses a bare email address and lowercases it.
+func normalizeEmail(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s {
+		return "", false
+	}
+	return strings.ToLower(addr.Address), true
+}
+
+// allowMagicLink rate limits login links per email and per client IP.
+// It returns how long to wait if the link can't be sent yet.
+// Requests are recorded in the database so the limits hold across instances.
+func allowMagicLink(ctx context.Context, email, ip string) (time.Duration, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not begin tx: %w", err)
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	var sentToEmail bool
+	var sentFromIP int
+	if err = tx.QueryRowContext(ctx, `
+		SELECT
+			EXISTS (
+				SELECT 1 FROM magic_link_requests
+				WHERE email = $1 AND created_at > now() - $3 * INTERVAL '1 second'
+			),
+			(
+				SELECT count(*) FROM magic_link_requests
+				WHERE ip = $2 AND created_at > now() - $4 * INTERVAL '1 second'
+			)
+	`, email, ip, int(magicLinkMinInterval.Seconds()), int(magicLinkIPWindow.Seconds())).Scan(
+		&sentToEmail,
+		&sentFromIP,
+	); err != nil {
+		return 0, fmt.Errorf("could not query magic link requests: %w", err)
+	}
+
+	if sentToEmail {
+		return magicLinkMinInterval, nil
+	}
+
+	if sentFromIP >= maxMagicLinksPerIP {
+		return magicLinkIPWindow, nil
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		INSERT INTO magic_link_requests (email, ip) VALUES ($1, $2)
+	`, email, ip); err != nil {
+		return 0, fmt.Errorf("could not insert magic link request: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not commit tx to rate limit magic link: %w", err)
+	}
+
+	go func() {
+		if _, err := db.Exec(`
+			DELETE FROM magic_link_requests WHERE created_at < now() - $1 * INTERVAL '1 second'
+		`, int(magicLinkIPWindow.Seconds())); err != nil {
+			log.Printf("failed to do delete old magic link requests afterwork: %v\n", err)
+		}
+	}()
+
+	return 0, nil
+}
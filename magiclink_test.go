@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/kenshaw/jwt"
+)
+
+var rxMagicLinkToken = regexp.MustCompile(`/magic-link\?(\S+)`)
+
+// setupTestDB points db to a database created from schema.sql
+// when TEST_DATABASE_URL is set.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	testDB, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		testDB.Close()
+	})
+
+	if err = testDB.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = testDB
+}
+
+// TestMagicLink drives the login link flow with a FileMailer
+// and reads the link from the written email.
+func TestMagicLink(t *testing.T) {
+	setupTestDB(t)
+
+	var err error
+	if origin, err = url.Parse("http://localhost:3000/"); err != nil {
+		t.Fatal(err)
+	}
+	if jwtSigner, err = jwt.HS256.New([]byte("testkey")); err != nil {
+		t.Fatal(err)
+	}
+	magicLinkSigner = securecookie.New([]byte("testkey"), nil).MaxAge(int(magicLinkLifetime.Seconds()))
+
+	dir := t.TempDir()
+	mailer = FileMailer{Dir: dir, From: "messenger@localhost"}
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	email := "magic_link_test_" + suffix + "@example.org"
+	ip := "203.0.113.7"
+
+	t.Cleanup(func() {
+		_, _ = db.Exec(`DELETE FROM magic_link_requests WHERE email = $1 OR ip = $2`, email, ip)
+		_, _ = db.Exec(`
+			DELETE FROM users WHERE id IN (
+				SELECT user_id FROM user_identities WHERE provider = 'email' AND provider_user_id = $1
+			)
+		`, email)
+	})
+
+	if resp := requestMagicLink(email, ip); resp.Code != http.StatusAccepted {
+		t.Fatalf("sendMagicLink() status = %d, want %d: %s", resp.Code, http.StatusAccepted, resp.Body)
+	}
+
+	token := readMagicLinkToken(t, dir)
+
+	resp := exchangeMagicLink(token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("magicLinkLogin() status = %d, want %d: %s", resp.Code, http.StatusOK, resp.Body)
+	}
+
+	var out struct {
+		AuthUser User   `json:"authUser"`
+		Token    string `json:"token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Token == "" || !strings.HasPrefix(out.AuthUser.Username, "magic_link_test_"+suffix) {
+		t.Errorf("magicLinkLogin() = %+v, want a token for the email user", out)
+	}
+
+	t.Run("used twice", func(t *testing.T) {
+		if resp := exchangeMagicLink(token); resp.Code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want %d", resp.Code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		expired, err := magicLinkSigner.Encode("magic_link", magicLink{
+			ID:        "expired-" + suffix,
+			Email:     email,
+			ExpiresAt: time.Now().Add(-time.Second),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp := exchangeMagicLink(expired); resp.Code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want %d", resp.Code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("per email limit", func(t *testing.T) {
+		resp := requestMagicLink(email, "203.0.113.8")
+		if resp.Code != http.StatusTooManyRequests {
+			t.Fatalf("status = %d, want %d", resp.Code, http.StatusTooManyRequests)
+		}
+		if resp.Header().Get("Retry-After") == "" {
+			t.Error("Retry-After header missing")
+		}
+	})
+}
+
+func requestMagicLink(email, ip string) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(map[string]string{"email": email})
+	req := httptest.NewRequest(http.MethodPost, "/api/magic_links", strings.NewReader(string(b)))
+	req.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	sendMagicLink(w, req)
+	return w
+}
+
+func exchangeMagicLink(token string) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(map[string]string{"token": token})
+	req := httptest.NewRequest(http.MethodPost, "/api/magic_link_login", strings.NewReader(string(b)))
+	w := httptest.NewRecorder()
+	magicLinkLogin(w, req)
+	return w
+}
+
+// readMagicLinkToken waits for the email, sent in the background,
+// to be written inside dir and takes the token from its link.
+func readMagicLinkToken(t *testing.T, dir string) string {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		names, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The file might still be half written.
+		if len(names) != 0 {
+			b, err := ioutil.ReadFile(names[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if m := rxMagicLinkToken.FindSubmatch(b); m != nil && strings.Contains(string(b), "expires in") {
+				q, err := url.ParseQuery(string(m[1]))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return q.Get("token")
+			}
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("no email with a login link written")
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text emails.
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// SMTPMailer sends emails through an SMTP server.
+type SMTPMailer struct {
+	// Addr of the server like "smtp.example.org:587".
+	Addr string
+	// Auth is optional.
+	Auth smtp.Auth
+	From string
+}
+
+// LogMailer just logs emails. Useful in development.
+type LogMailer struct{}
+
+// FileMailer writes each email as a .eml file inside Dir.
+// Useful in development and tests.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+// Send the email.
+// The context is ignored since net/smtp doesn't support it.
+func (m SMTPMailer) Send(_ context.Context, to, subject, body string) error {
+	if err := smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, mailMessage(m.From, to, subject, body)); err != nil {
+		return fmt.Errorf("could not send mail: %w", err)
+	}
+	return nil
+}
+
+// Send logs the email.
+func (LogMailer) Send(_ context.Context, to, subject, body string) error {
+	log.Printf("mail to %s: %s\n%s\n", to, subject, body)
+	return nil
+}
+
+// Send writes the email to a new file.
+func (m FileMailer) Send(_ context.Context, to, subject, body string) error {
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return fmt.Errorf("could not create mail dir: %w", err)
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.ReplaceAll(to, string(filepath.Separator), "_"))
+	if err := ioutil.WriteFile(filepath.Join(m.Dir, name), mailMessage(m.From, to, subject, body), 0644); err != nil {
+		return fmt.Errorf("could not write mail file: %w", err)
+	}
+
+	return nil
+}
+
+// mailMessage formats a plain text email.
+func mailMessage(from, to, subject, body string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return b.Bytes()
+}
@@ -3,21 +3,24 @@ package main
 import (
 	"context"
 	"database/sql"
+	"expvar"
 	"fmt"
 	"log"
 	"mime"
+	"net"
 	"net/http"
+	"net/smtp"
 	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/gorilla/securecookie"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/joho/godotenv"
 	"github.com/kenshaw/jwt"
+	gonanoid "github.com/matoous/go-nanoid"
 	"github.com/matryer/way"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
@@ -25,10 +28,14 @@ import (
 
 var origin *url.URL
 var db *sql.DB
-var githubOAuthConfig oauth2.Config
 var cookieSigner *securecookie.SecureCookie
 var jwtSigner jwt.Signer
-var messageClients sync.Map
+var hub *Hub
+var messageDeletionWindow time.Duration
+var blobStore BlobStore
+var maxAttachmentSize int64
+var pubsub PubSub
+var mailer Mailer
 
 func main() {
 	_ = godotenv.Load()
@@ -39,10 +46,40 @@ func main() {
 		databaseURL        = env("DATABASE_URL", "postgresql://root@127.0.0.1:26257/messenger?sslmode=disable")
 		hashKey            = env("HASH_KEY", "supersecretkeyyoushouldnotcommit")
 		jwtKey             = env("JWT_KEY", "supersecretkeyyoushouldnotcommit")
+		totpKey            = env("TOTP_KEY", "supersecretkeyyoushouldnotcommit")
 		githubClientID     = os.Getenv("GITHUB_CLIENT_ID")
 		githubClientSecret = os.Getenv("GITHUB_CLIENT_SECRET")
+		gitlabURL          = env("GITLAB_URL", "https://gitlab.com")
+		gitlabClientID     = os.Getenv("GITLAB_CLIENT_ID")
+		gitlabClientSecret = os.Getenv("GITLAB_CLIENT_SECRET")
+		googleClientID     = os.Getenv("GOOGLE_CLIENT_ID")
+		googleClientSecret = os.Getenv("GOOGLE_CLIENT_SECRET")
+		oidcIssuer         = os.Getenv("OIDC_ISSUER")
+		oidcClientID       = os.Getenv("OIDC_CLIENT_ID")
+		oidcClientSecret   = os.Getenv("OIDC_CLIENT_SECRET")
+		oidcName           = env("OIDC_NAME", "oidc")
+		oidcTitle          = env("OIDC_TITLE", "Single sign-on")
+		mailerKind         = os.Getenv("MAILER")
+		smtpAddr           = os.Getenv("SMTP_ADDR")
+		smtpUsername       = os.Getenv("SMTP_USERNAME")
+		smtpPassword       = os.Getenv("SMTP_PASSWORD")
+		mailFrom           = env("MAIL_FROM", "messenger@localhost")
+		mailDir            = os.Getenv("MAIL_DIR")
+		blobsDir           = env("BLOBS_DIR", "data/blobs")
+		s3EndpointString   = os.Getenv("S3_ENDPOINT")
+		s3Region           = env("S3_REGION", "us-east-1")
+		s3Bucket           = env("S3_BUCKET", "messenger")
+		s3AccessKeyID      = os.Getenv("S3_ACCESS_KEY_ID")
+		s3SecretAccessKey  = os.Getenv("S3_SECRET_ACCESS_KEY")
+		pubsubURL          = os.Getenv("PUBSUB_URL")
+		pubsubChannel      = env("PUBSUB_CHANNEL", "messenger_events")
+		slowClientPolicy   = env("SLOW_CLIENT_POLICY", SlowClientDisconnect)
+		metricsAddr        = os.Getenv("METRICS_ADDR")
 	)
 
+	messageDeletionWindow = durationEnv("MESSAGE_DELETION_WINDOW", time.Hour)
+	maxAttachmentSize = int64(intEnv("MAX_ATTACHMENT_SIZE", 10<<20)) // 10MB.
+
 	var err error
 	if origin, err = url.Parse(originString); err != nil || !origin.IsAbs() {
 		log.Fatal("invalid origin")
@@ -53,11 +90,6 @@ func main() {
 		port = i
 	}
 
-	if githubClientID == "" || githubClientSecret == "" {
-		log.Fatalf("remember to set both $GITHUB_CLIENT_ID and $GITHUB_CLIENT_SECRET")
-		return
-	}
-
 	if db, err = sql.Open("pgx", databaseURL); err != nil {
 		log.Fatalf("could not open database connection: %v\n", err)
 		return
@@ -68,17 +100,173 @@ func main() {
 		return
 	}
 
-	githubRedirectURL := cloneURL(origin)
-	githubRedirectURL.Path = "/api/oauth/github/callback"
-	githubOAuthConfig = oauth2.Config{
-		ClientID:     githubClientID,
-		ClientSecret: githubClientSecret,
-		Endpoint:     github.Endpoint,
-		RedirectURL:  githubRedirectURL.String(),
-		Scopes:       []string{"read:user"},
+	if githubClientID != "" {
+		registerOAuthProvider("github", "GitHub", GitHubProvider{Config: oauth2.Config{
+			ClientID:     githubClientID,
+			ClientSecret: githubClientSecret,
+			Endpoint:     github.Endpoint,
+			RedirectURL:  oauthRedirectURL("github"),
+			Scopes:       []string{"read:user"},
+		}})
+	}
+
+	for _, c := range []struct {
+		name, title, issuer, clientID, clientSecret string
+	}{
+		{"gitlab", "GitLab", gitlabURL, gitlabClientID, gitlabClientSecret},
+		{"google", "Google", "https://accounts.google.com", googleClientID, googleClientSecret},
+		{oidcName, oidcTitle, oidcIssuer, oidcClientID, oidcClientSecret},
+	} {
+		if c.issuer == "" || c.clientID == "" {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		p, err := discoverOIDCProvider(ctx, c.issuer, oauth2.Config{
+			ClientID:     c.clientID,
+			ClientSecret: c.clientSecret,
+			RedirectURL:  oauthRedirectURL(c.name),
+		})
+		cancel()
+		if err != nil {
+			log.Fatalf("could not discover %s provider: %v\n", c.name, err)
+			return
+		}
+
+		registerOAuthProvider(c.name, c.title, p)
+	}
+
+	if len(oauthProviders) == 0 {
+		log.Println("no oauth providers configured; set $GITHUB_CLIENT_ID or $OIDC_ISSUER and $OIDC_CLIENT_ID for example")
+	}
+
+	if s3EndpointString != "" {
+		s3Endpoint, err := url.Parse(s3EndpointString)
+		if err != nil || !s3Endpoint.IsAbs() {
+			log.Fatalln("invalid S3 endpoint")
+			return
+		}
+
+		blobStore = S3BlobStore{
+			Endpoint:        s3Endpoint,
+			Region:          s3Region,
+			Bucket:          s3Bucket,
+			AccessKeyID:     s3AccessKeyID,
+			SecretAccessKey: s3SecretAccessKey,
+			Client:          &http.Client{Timeout: time.Minute},
+		}
+	} else {
+		blobStore = FSBlobStore{Dir: blobsDir}
+	}
+
+	// Logged or written login links work for whoever reads them,
+	// so those mailers are only picked by default on localhost.
+	if mailerKind == "" {
+		switch {
+		case smtpAddr != "":
+			mailerKind = "smtp"
+		case !isLocalhost(origin):
+			log.Fatalln("no mailer configured; set $SMTP_ADDR, or $MAILER to log or file")
+			return
+		case mailDir != "":
+			mailerKind = "file"
+		default:
+			mailerKind = "log"
+		}
+	}
+
+	switch mailerKind {
+	case "smtp":
+		if smtpAddr == "" {
+			log.Fatalln("$SMTP_ADDR required by the smtp mailer")
+			return
+		}
+
+		m := SMTPMailer{Addr: smtpAddr, From: mailFrom}
+		if smtpUsername != "" {
+			host, _, _ := net.SplitHostPort(smtpAddr)
+			m.Auth = smtp.PlainAuth("", smtpUsername, smtpPassword, host)
+		}
+		mailer = m
+	case "file":
+		if mailDir == "" {
+			log.Fatalln("$MAIL_DIR required by the file mailer")
+			return
+		}
+
+		mailer = FileMailer{Dir: mailDir, From: mailFrom}
+	case "log":
+		mailer = LogMailer{}
+	default:
+		log.Fatalf("invalid mailer %q\n", mailerKind)
+		return
+	}
+
+	if slowClientPolicy != SlowClientDisconnect && slowClientPolicy != SlowClientDrop {
+		log.Fatalf("invalid slow client policy %q\n", slowClientPolicy)
+		return
+	}
+
+	hub = newHub(slowClientPolicy)
+
+	if metricsAddr != "" {
+		expvar.Publish("hub", expvar.Func(func() interface{} {
+			return hub.stats()
+		}))
+
+		go func() {
+			log.Printf("serving metrics at %s/debug/vars\n", metricsAddr)
+			if err := http.ListenAndServe(metricsAddr, expvar.Handler()); err != nil {
+				log.Printf("could not serve metrics: %v\n", err)
+			}
+		}()
 	}
 
+	if pubsubURL != "" {
+		pubsubDB, err := sql.Open("pgx", pubsubURL)
+		if err != nil {
+			log.Fatalf("could not open pubsub database connection: %v\n", err)
+			return
+		}
+		defer pubsubDB.Close()
+
+		pubsub = PostgresPubSub{
+			DB:         pubsubDB,
+			ConnString: pubsubURL,
+			Channel:    pubsubChannel,
+		}
+
+		sharedPresence = true
+		if instanceID, err = gonanoid.Nanoid(); err != nil {
+			log.Fatalf("could not generate instance id: %v\n", err)
+			return
+		}
+
+		if err = startPresenceHeartbeat(); err != nil {
+			log.Fatalf("could not start presence heartbeat: %v\n", err)
+			return
+		}
+	} else {
+		pubsub = &MemoryPubSub{}
+	}
+
+	if err = pubsub.Subscribe(context.Background(), deliver); err != nil {
+		log.Fatalf("could not subscribe to pubsub: %v\n", err)
+		return
+	}
+
+	startImageWorkers(2)
+	startAttachmentSweeper()
+
 	cookieSigner = securecookie.New([]byte(hashKey), nil).MaxAge(0)
+	magicLinkSigner = securecookie.New([]byte(hashKey), nil).MaxAge(int(magicLinkLifetime.Seconds()))
+	twoFactorSigner = securecookie.New([]byte(hashKey), nil).MaxAge(int(twoFactorLoginLifetime.Seconds()))
+
+	totpCipher, err = newTOTPCipher(totpKey)
+	if err != nil {
+		log.Fatalf("could not create TOTP cipher: %v\n", err)
+		return
+	}
 
 	jwtSigner, err = jwt.HS256.New([]byte(jwtKey))
 	if err != nil {
@@ -93,18 +281,50 @@ func main() {
 
 	router := way.NewRouter()
 	router.HandleFunc("POST", "/api/login", requireJSON(login))
-	router.HandleFunc("GET", "/api/oauth/github", githubOAuthStart)
-	router.HandleFunc("GET", "/api/oauth/github/callback", githubOAuthCallback)
+	router.HandleFunc("GET", "/api/oauth_providers", getOAuthProviders)
+	router.HandleFunc("GET", "/api/oauth/:provider", oauthStart)
+	router.HandleFunc("GET", "/api/oauth/:provider/callback", oauthCallback)
+	router.HandleFunc("GET", "/api/identities", guard(getIdentities))
+	router.HandleFunc("DELETE", "/api/identities/:provider", guard(unlinkIdentity))
 	router.HandleFunc("GET", "/api/auth_user", guard(getAuthUser))
-	router.HandleFunc("POST", "/api/refresh_token", guard(refreshToken))
+	router.HandleFunc("POST", "/api/magic_links", requireJSON(sendMagicLink))
+	router.HandleFunc("POST", "/api/magic_link_login", requireJSON(magicLinkLogin))
+	router.HandleFunc("POST", "/api/two_factor/login", requireJSON(twoFactorLoginStep))
+	router.HandleFunc("POST", "/api/two_factor/enroll", guard(enrollTwoFactor))
+	router.HandleFunc("POST", "/api/two_factor/confirm", requireJSON(guard(confirmTwoFactor)))
+	router.HandleFunc("POST", "/api/two_factor/disable", requireJSON(guard(disableTwoFactor)))
+	router.HandleFunc("POST", "/api/refresh_token", requireJSON(refreshToken))
+	router.HandleFunc("POST", "/api/logout", guard(logout))
+	router.HandleFunc("GET", "/api/sessions", guard(getSessions))
+	router.HandleFunc("DELETE", "/api/sessions", guard(revokeAllSessions))
+	router.HandleFunc("DELETE", "/api/sessions/:session_id", guard(revokeSession))
 	router.HandleFunc("GET", "/api/usernames", guard(searchUsernames))
+	router.HandleFunc("GET", "/api/settings", guard(getSettings))
+	router.HandleFunc("PATCH", "/api/settings", requireJSON(guard(updateSettings)))
 	router.HandleFunc("POST", "/api/conversations", requireJSON(guard(createConversation)))
 	router.HandleFunc("GET", "/api/conversations", guard(getConversations))
 	router.HandleFunc("GET", "/api/conversations/:conversation_id", guard(getConversation))
-	router.HandleFunc("GET", "/api/conversations/:conversation_id/other_participant", guard(getOtherParticipantFromConversation))
+	router.HandleFunc("GET", "/api/unread_count", guard(getUnreadCount))
+	router.HandleFunc("GET", "/api/conversations/:conversation_id/participants", guard(getParticipants))
+	router.HandleFunc("POST", "/api/conversations/:conversation_id/participants", requireJSON(guard(addParticipant)))
+	router.HandleFunc("DELETE", "/api/conversations/:conversation_id/participants/:user_id", guard(removeParticipant))
+	router.HandleFunc("POST", "/api/conversations/:conversation_id/leave", guard(leaveConversation))
 	router.HandleFunc("POST", "/api/conversations/:conversation_id/messages", requireJSON(guard(createMessage)))
 	router.HandleFunc("GET", "/api/conversations/:conversation_id/messages", guard(getMessages))
+	router.HandleFunc("PATCH", "/api/conversations/:conversation_id/messages/:message_id", requireJSON(guard(updateMessage)))
+	router.HandleFunc("DELETE", "/api/conversations/:conversation_id/messages/:message_id", guard(deleteMessage))
+	router.HandleFunc("GET", "/api/conversations/:conversation_id/messages/:message_id/revisions", guard(getMessageRevisions))
+	router.HandleFunc("GET", "/api/conversations/:conversation_id/messages/:message_id/replies", guard(getReplies))
+	router.HandleFunc("POST", "/api/conversations/:conversation_id/messages/:message_id/reactions", requireJSON(guard(addReaction)))
+	router.HandleFunc("DELETE", "/api/conversations/:conversation_id/messages/:message_id/reactions", guard(removeReaction))
+	router.HandleFunc("POST", "/api/conversations/:conversation_id/typing", guard(startTyping))
+	router.HandleFunc("DELETE", "/api/conversations/:conversation_id/typing", guard(stopTyping))
+	router.HandleFunc("POST", "/api/conversations/:conversation_id/attachments", guard(uploadAttachment))
+	router.HandleFunc("GET", "/api/attachments/:attachment_id", guard(getAttachment))
+	router.HandleFunc("GET", "/api/attachments/:attachment_id/thumbnails/:size", guard(getThumbnail))
 	router.HandleFunc("GET", "/api/messages", guard(subscribeToMessages))
+	router.HandleFunc("GET", "/api/messages/search", guard(searchMessages))
+	router.HandleFunc("GET", "/api/ws", guard(websocketHandler(router)))
 	router.HandleFunc("POST", "/api/conversations/:conversation_id/read_messages", guard(readMessages))
 	router.HandleFunc("*", "/api/...", http.NotFound)
 	router.Handle("GET", "/...", http.FileServer(SPAFileSystem{http.Dir("static")}))
@@ -114,12 +334,25 @@ func main() {
 		Handler:           router,
 		ReadHeaderTimeout: time.Second * 5,
 		ReadTimeout:       time.Second * 10,
+		// No WriteTimeout since it would cut realtime streams.
+		// Those rely on heartbeats and a max lifetime instead.
+		IdleTimeout: time.Minute * 2,
+		// So handlers like uploads can extend their read deadline.
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, keyConn, c)
+		},
 	}
 
+	// Streams would keep Shutdown waiting until its timeout otherwise.
+	s.RegisterOnShutdown(hub.closeAll)
+
 	go func() {
 		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, os.Interrupt)
 		<-quit
+		if sharedPresence {
+			stopPresence()
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 		defer cancel()
 		if err := s.Shutdown(ctx); err != nil {
@@ -134,6 +367,17 @@ func main() {
 	}
 }
 
+// isLocalhost reports whether the URL points to this same machine.
+func isLocalhost(u *url.URL) bool {
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func env(key, fallbackValue string) string {
 	v, ok := os.LookupEnv(key)
 	if !ok {
@@ -154,6 +398,18 @@ func intEnv(key string, fallbackValue int) int {
 	return i
 }
 
+func durationEnv(key string, fallbackValue time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallbackValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fallbackValue
+	}
+	return d
+}
+
 func cloneURL(u *url.URL) *url.URL {
 	if u == nil {
 		return nil
@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -17,27 +16,47 @@ import (
 
 var rxSpaces = regexp.MustCompile(`\s+`)
 
+const (
+	maxMessageLength     = 480
+	messagePreviewLength = 100
+	messagesPageSize     = 25
+)
+
 // Message model.
 type Message struct {
-	ID             string    `json:"id"`
-	Content        string    `json:"content"`
-	UserID         string    `json:"-"`
-	ConversationID string    `json:"conversationId,omitempty"`
-	CreatedAt      time.Time `json:"createdAt"`
-	Mine           bool      `json:"mine"`
-	ReceiverID     string    `json:"-"`
+	ID             string          `json:"id"`
+	Content        string          `json:"content"`
+	UserID         string          `json:"-"`
+	ConversationID string          `json:"conversationId,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	EditedAt       *time.Time      `json:"editedAt"`
+	DeletedAt      *time.Time      `json:"deletedAt,omitempty"`
+	Mine           bool            `json:"mine"`
+	System         bool            `json:"system"`
+	User           *User           `json:"user,omitempty"`
+	ReplyToID      *string         `json:"replyToId,omitempty"`
+	ReplyTo        *MessagePreview `json:"replyTo,omitempty"`
+	Reactions      []Reaction      `json:"reactions,omitempty"`
+	Attachments    []Attachment    `json:"attachments,omitempty"`
+	Status         string          `json:"status,omitempty"`
+	ReceiverIDs    []string        `json:"-"`
 }
 
-// MessageClient to subscribe to new messages.
-type MessageClient struct {
-	Messages chan Message
-	UserID   string
+// MessagePreview is a compact version of a message
+// shown along with its replies.
+type MessagePreview struct {
+	ID        string     `json:"id"`
+	Content   string     `json:"content"`
+	User      User       `json:"user"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
 }
 
 // POST /api/conversations/{conversation_id}/messages
 func createMessage(w http.ResponseWriter, r *http.Request) {
 	var in struct {
-		Content string `json:"content"`
+		Content       string   `json:"content"`
+		ReplyToID     *string  `json:"replyToId"`
+		AttachmentIDs []string `json:"attachmentIds"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -47,10 +66,18 @@ func createMessage(w http.ResponseWriter, r *http.Request) {
 
 	errs := make(map[string]string)
 	in.Content = removeSpaces(in.Content)
-	if in.Content == "" {
+	if in.Content == "" && len(in.AttachmentIDs) == 0 {
 		errs["content"] = "Message content required"
-	} else if len([]rune(in.Content)) > 480 {
-		errs["content"] = "Message too long. 480 max"
+	} else if len([]rune(in.Content)) > maxMessageLength {
+		errs["content"] = fmt.Sprintf("Message too long. %d max", maxMessageLength)
+	}
+	if len(in.AttachmentIDs) > maxAttachmentsPerMessage {
+		errs["attachmentIds"] = fmt.Sprintf("Too many attachments. %d max", maxAttachmentsPerMessage)
+	}
+	if in.ReplyToID != nil {
+		if *in.ReplyToID = strings.TrimSpace(*in.ReplyToID); *in.ReplyToID == "" {
+			in.ReplyToID = nil
+		}
 	}
 	if len(errs) != 0 {
 		respond(w, Errors{errs}, http.StatusUnprocessableEntity)
@@ -80,25 +107,56 @@ func createMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var m Message
-	if err := tx.QueryRowContext(ctx, `
-		INSERT INTO messages (content, user_id, conversation_id) VALUES
-			($1, $2, $3)
-		RETURNING id, created_at
-	`, in.Content, uid, cid).Scan(
-		&m.ID,
-		&m.CreatedAt,
-	); err != nil {
+	if in.ReplyToID != nil {
+		var replyToExists bool
+		if err = tx.QueryRowContext(ctx, `SELECT EXISTS (
+			SELECT 1 FROM messages
+			WHERE id = $1 AND conversation_id = $2 AND deleted_at IS NULL
+		)`, *in.ReplyToID, cid).Scan(&replyToExists); err != nil {
+			respondError(w, fmt.Errorf("could not query reply to message existance: %w", err))
+			return
+		}
+
+		if !replyToExists {
+			respond(w, Errors{map[string]string{
+				"replyToId": "Message to reply to not found in this conversation",
+			}}, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	m, err := insertMessage(ctx, tx, Message{
+		Content:        in.Content,
+		UserID:         uid,
+		ConversationID: cid,
+		ReplyToID:      in.ReplyToID,
+	})
+	if err != nil {
 		respondError(w, fmt.Errorf("could not insert message: %w", err))
 		return
 	}
 
-	if _, err := tx.ExecContext(ctx, `
-		UPDATE conversations SET last_message_id = $1
-		WHERE id = $2
-	`, m.ID, cid); err != nil {
-		respondError(w, fmt.Errorf("could not update conversation last message ID: %w", err))
-		return
+	if len(in.AttachmentIDs) != 0 {
+		ok, err := attachToMessage(ctx, tx, uid, cid, m.ID, in.AttachmentIDs)
+		if err != nil {
+			respondError(w, fmt.Errorf("could not attach files to message: %w", err))
+			return
+		}
+
+		if !ok {
+			respond(w, Errors{map[string]string{
+				"attachmentIds": "Attachment not found",
+			}}, http.StatusUnprocessableEntity)
+			return
+		}
+
+		attachments, err := queryAttachments(ctx, tx, m.ID)
+		if err != nil {
+			respondError(w, fmt.Errorf("could not query message attachments: %w", err))
+			return
+		}
+
+		m.Attachments = attachments[m.ID]
 	}
 
 	if err = tx.Commit(); err != nil {
@@ -106,16 +164,14 @@ func createMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	typingStopped(uid, cid)
+
 	go func() {
-		if err = updateMessagesReadAt(context.Background(), uid, cid); err != nil {
+		if err = updateMessagesReadAt(context.Background(), uid, cid, nil); err != nil {
 			log.Printf("could not update messages read at: %v\n", err)
 		}
 	}()
 
-	m.Content = in.Content
-	m.UserID = uid
-	m.ConversationID = cid
-
 	go func() {
 		if err := messageCreated(m); err != nil {
 			log.Printf("failed to do message created afterwork: %v\n", err)
@@ -123,10 +179,96 @@ func createMessage(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	m.Mine = true
+	m.Status = MessageStatusSent
 
 	respond(w, m, http.StatusCreated)
 }
 
+// insertMessage inserts the message content, user ID, conversation ID,
+// system flag and reply to ID given, and makes it the last message of the conversation.
+func insertMessage(ctx context.Context, tx *sql.Tx, m Message) (Message, error) {
+	if err := tx.QueryRowContext(ctx, `
+		INSERT INTO messages (content, user_id, conversation_id, system, reply_to_id) VALUES
+			($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, m.Content, m.UserID, m.ConversationID, m.System, m.ReplyToID).Scan(
+		&m.ID,
+		&m.CreatedAt,
+	); err != nil {
+		return m, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE conversations SET last_message_id = $1
+		WHERE id = $2
+	`, m.ID, m.ConversationID); err != nil {
+		return m, fmt.Errorf("could not update conversation last message ID: %w", err)
+	}
+
+	// System messages like "alice added bob" don't count as unread.
+	if !m.System {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE participants SET unread_messages_count = unread_messages_count + 1
+			WHERE conversation_id = $1 AND user_id != $2
+		`, m.ConversationID, m.UserID); err != nil {
+			return m, fmt.Errorf("could not increment unread messages count: %w", err)
+		}
+	}
+
+	author, err := queryUser(ctx, tx, m.UserID)
+	if err != nil {
+		return m, fmt.Errorf("could not query message author: %w", err)
+	}
+
+	m.User = &author
+
+	if m.ReplyToID != nil {
+		replyTo, err := queryMessagePreview(ctx, tx, *m.ReplyToID)
+		if err != nil {
+			return m, fmt.Errorf("could not query reply to message preview: %w", err)
+		}
+
+		m.ReplyTo = &replyTo
+	}
+
+	return m, nil
+}
+
+func queryMessagePreview(ctx context.Context, tx *sql.Tx, id string) (MessagePreview, error) {
+	p := MessagePreview{ID: id}
+	if err := tx.QueryRowContext(ctx, `
+		SELECT
+			messages.content,
+			messages.deleted_at,
+			users.id,
+			users.username,
+			users.avatar_url
+		FROM messages
+		INNER JOIN users ON messages.user_id = users.id
+		WHERE messages.id = $1
+	`, id).Scan(
+		&p.Content,
+		&p.DeletedAt,
+		&p.User.ID,
+		&p.User.Username,
+		&p.User.AvatarURL,
+	); err != nil {
+		return p, err
+	}
+
+	p.Content = truncate(p.Content, messagePreviewLength)
+	return p, nil
+}
+
+// truncate s to the given amount of runes adding an ellipsis.
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+	return strings.TrimSpace(string(runes[:length])) + "…"
+}
+
 func removeSpaces(s string) string {
 	if s == "" {
 		return s
@@ -144,25 +286,55 @@ func removeSpaces(s string) string {
 }
 
 func messageCreated(m Message) error {
-	if err := db.QueryRow(`
-		SELECT user_id FROM participants
-		WHERE user_id != $1 and conversation_id = $2
-	`, m.UserID, m.ConversationID).Scan(&m.ReceiverID); err != nil {
+	uids, err := queryParticipantIDs(context.Background(), db, m.ConversationID)
+	if err != nil {
 		return err
 	}
 
-	go broadcastMessage(m)
+	// Receivers set beforehand, like users just removed
+	// from the conversation, are kept.
+	// The sender is included so its other devices get it too.
+	m.ReceiverIDs = append(m.ReceiverIDs, uids...)
+
+	go broadcast(Event{Name: EventMessageCreated, Data: m, ReceiverIDs: m.ReceiverIDs})
 
 	return nil
 }
 
-// GET /api/conversations/{conversation_id}/messages?before={before}
-func getMessages(w http.ResponseWriter, r *http.Request) {
+// PATCH /api/conversations/{conversation_id}/messages/{message_id}
+func updateMessage(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	errs := make(map[string]string)
+	in.Content = removeSpaces(in.Content)
+	if in.Content == "" {
+		errs["content"] = "Message content required"
+	} else if len([]rune(in.Content)) > maxMessageLength {
+		errs["content"] = fmt.Sprintf("Message too long. %d max", maxMessageLength)
+	}
+	if len(errs) != 0 {
+		respond(w, Errors{errs}, http.StatusUnprocessableEntity)
+		return
+	}
+
 	ctx := r.Context()
 	uid := ctx.Value(keyAuthUserID).(string)
 	cid := way.Param(ctx, "conversation_id")
+	mid := way.Param(ctx, "message_id")
 
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if !isID(cid) || !isID(mid) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		respondError(w, fmt.Errorf("could not begin tx: %w", err))
 		return
@@ -181,109 +353,729 @@ func getMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := `
-		SELECT
-			id,
-			content,
-			created_at,
-			user_id = $1 AS mine
+	m := Message{ID: mid, ConversationID: cid}
+	if err = tx.QueryRowContext(ctx, `
+		SELECT content, user_id, system, created_at, edited_at
 		FROM messages
-		WHERE conversation_id = $2`
-	args := []interface{}{uid, cid}
+		WHERE id = $1 AND conversation_id = $2 AND deleted_at IS NULL
+		FOR UPDATE
+	`, mid, cid).Scan(
+		&m.Content,
+		&m.UserID,
+		&m.System,
+		&m.CreatedAt,
+		&m.EditedAt,
+	); err == sql.ErrNoRows {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query message: %w", err))
+		return
+	}
 
-	if before := strings.TrimSpace(r.URL.Query().Get("before")); before != "" {
-		query += ` AND id < $3`
-		args = append(args, before)
+	if m.UserID != uid || m.System {
+		http.Error(w, "You can only edit your own messages", http.StatusForbidden)
+		return
 	}
 
-	query += `
-		ORDER BY created_at DESC
-		LIMIT 25`
+	author, err := queryUser(ctx, tx, uid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query message author: %w", err))
+		return
+	}
 
-	rows, err := tx.QueryContext(ctx, query, args...)
+	m.User = &author
+	m.Mine = true
+
+	if m.Content == in.Content {
+		respond(w, m, http.StatusOK)
+		return
+	}
+
+	// The revision keeps the previous content along with the time it was written.
+	revisedAt := m.CreatedAt
+	if m.EditedAt != nil {
+		revisedAt = *m.EditedAt
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		INSERT INTO message_revisions (message_id, content, created_at) VALUES
+			($1, $2, $3)
+	`, mid, m.Content, revisedAt); err != nil {
+		respondError(w, fmt.Errorf("could not insert message revision: %w", err))
+		return
+	}
+
+	if err = tx.QueryRowContext(ctx, `
+		UPDATE messages SET content = $1, edited_at = now()
+		WHERE id = $2
+		RETURNING edited_at
+	`, in.Content, mid).Scan(&m.EditedAt); err != nil {
+		respondError(w, fmt.Errorf("could not update message: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to update message: %w", err))
+		return
+	}
+
+	m.Content = in.Content
+
+	go func(m Message) {
+		m.Mine = false
+		if err := messageUpdated(m); err != nil {
+			log.Printf("failed to do message updated afterwork: %v\n", err)
+		}
+	}(m)
+
+	respond(w, m, http.StatusOK)
+}
+
+func messageUpdated(m Message) error {
+	uids, err := queryParticipantIDs(context.Background(), db, m.ConversationID)
+	if err != nil {
+		return err
+	}
+
+	m.ReceiverIDs = append(m.ReceiverIDs, uids...)
+
+	go broadcast(Event{Name: EventMessageUpdated, Data: m, ReceiverIDs: m.ReceiverIDs})
+
+	return nil
+}
+
+// DELETE /api/conversations/{conversation_id}/messages/{message_id}?for={me|everyone}
+func deleteMessage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	cid := way.Param(ctx, "conversation_id")
+	mid := way.Param(ctx, "message_id")
+
+	if !isID(cid) || !isID(mid) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	forEveryone := false
+	switch r.URL.Query().Get("for") {
+	case "", "me":
+	case "everyone":
+		forEveryone = true
+	default:
+		respond(w, Errors{map[string]string{
+			"for": "Must be either me or everyone",
+		}}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		respondError(w, fmt.Errorf("could not query messages: %w", err))
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
 		return
 	}
-	defer rows.Close()
 
-	mm := make([]Message, 0, 25)
-	for rows.Next() {
-		var message Message
-		if err = rows.Scan(
-			&message.ID,
-			&message.Content,
-			&message.CreatedAt,
-			&message.Mine,
-		); err != nil {
-			respondError(w, fmt.Errorf("could not scan message: %w", err))
+	defer func() { _ = tx.Rollback() }()
+
+	isParticipant, err := queryParticipantExistance(ctx, tx, uid, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query participant existance: %w", err))
+		return
+	}
+
+	if !isParticipant {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	m := Message{ID: mid, ConversationID: cid}
+	if err = tx.QueryRowContext(ctx, `
+		SELECT user_id, system, created_at
+		FROM messages
+		WHERE id = $1 AND conversation_id = $2 AND deleted_at IS NULL
+		FOR UPDATE
+	`, mid, cid).Scan(
+		&m.UserID,
+		&m.System,
+		&m.CreatedAt,
+	); err == sql.ErrNoRows {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query message: %w", err))
+		return
+	}
+
+	if !forEveryone {
+		var hidden bool
+		if err = tx.QueryRowContext(ctx, `
+			INSERT INTO hidden_messages (user_id, message_id) VALUES ($1, $2)
+			ON CONFLICT (user_id, message_id) DO NOTHING
+			RETURNING true
+		`, uid, mid).Scan(&hidden); err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		} else if err != nil {
+			respondError(w, fmt.Errorf("could not hide message: %w", err))
 			return
 		}
 
-		mm = append(mm, message)
+		// I don't have to read it anymore.
+		if m.UserID != uid && !m.System {
+			if _, err = tx.ExecContext(ctx, `
+				UPDATE participants SET unread_messages_count = unread_messages_count - 1
+				WHERE conversation_id = $1
+					AND user_id = $2
+					AND messages_read_at < $3
+					AND unread_messages_count > 0
+			`, cid, uid, m.CreatedAt); err != nil {
+				respondError(w, fmt.Errorf("could not decrement unread messages count: %w", err))
+				return
+			}
+		}
+
+		if err = tx.Commit(); err != nil {
+			respondError(w, fmt.Errorf("could not commit tx to hide message: %w", err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
-	if err = rows.Err(); err != nil {
-		respondError(w, fmt.Errorf("could not iterate over messages: %w", err))
+	if m.UserID != uid || m.System {
+		http.Error(w, "You can only delete your own messages for everyone", http.StatusForbidden)
+		return
+	}
+
+	if messageDeletionWindow > 0 && time.Since(m.CreatedAt) > messageDeletionWindow {
+		http.Error(w, "Message too old to be deleted for everyone", http.StatusForbidden)
+		return
+	}
+
+	if err = tx.QueryRowContext(ctx, `
+		UPDATE messages SET content = '', edited_at = NULL, deleted_at = now()
+		WHERE id = $1
+		RETURNING deleted_at
+	`, mid).Scan(&m.DeletedAt); err != nil {
+		respondError(w, fmt.Errorf("could not tombstone message: %w", err))
+		return
+	}
+
+	// Participants that didn't read it yet don't have to.
+	if _, err = tx.ExecContext(ctx, `
+		UPDATE participants SET unread_messages_count = unread_messages_count - 1
+		WHERE conversation_id = $1
+			AND user_id != $2
+			AND messages_read_at < $3
+			AND unread_messages_count > 0
+	`, cid, uid, m.CreatedAt); err != nil {
+		respondError(w, fmt.Errorf("could not decrement unread messages count: %w", err))
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		DELETE FROM message_revisions WHERE message_id = $1
+	`, mid); err != nil {
+		respondError(w, fmt.Errorf("could not delete message revisions: %w", err))
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		DELETE FROM reactions WHERE message_id = $1
+	`, mid); err != nil {
+		respondError(w, fmt.Errorf("could not delete message reactions: %w", err))
+		return
+	}
+
+	blobKeys, err := deleteAttachments(ctx, tx, mid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not delete message attachments: %w", err))
+		return
+	}
+
+	// Point the conversation to the previous message still visible
+	// in case the deleted one was the last.
+	if _, err = tx.ExecContext(ctx, `
+		UPDATE conversations SET last_message_id = (
+			SELECT id FROM messages
+			WHERE conversation_id = $1 AND deleted_at IS NULL
+			ORDER BY created_at DESC
+			LIMIT 1
+		)
+		WHERE id = $1 AND last_message_id = $2
+	`, cid, mid); err != nil {
+		respondError(w, fmt.Errorf("could not update conversation last message ID: %w", err))
 		return
 	}
 
 	if err = tx.Commit(); err != nil {
-		respondError(w, fmt.Errorf("could not commit tx to get messages: %w", err))
+		respondError(w, fmt.Errorf("could not commit tx to delete message: %w", err))
 		return
 	}
 
+	go deleteBlobs(blobKeys...)
+
 	go func() {
-		if err = updateMessagesReadAt(context.Background(), uid, cid); err != nil {
-			log.Printf("could not update messages read at: %v\n", err)
+		if err := messageDeleted(m); err != nil {
+			log.Printf("failed to do message deleted afterwork: %v\n", err)
 		}
 	}()
 
-	respond(w, mm, http.StatusOK)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// GET /api/messages
-func subscribeToMessages(w http.ResponseWriter, r *http.Request) {
-	if a := r.Header.Get("Accept"); !strings.Contains(a, "text/event-stream") {
-		http.Error(w, "This endpoint requires an EventSource connection", http.StatusNotAcceptable)
+func messageDeleted(m Message) error {
+	uids, err := queryParticipantIDs(context.Background(), db, m.ConversationID)
+	if err != nil {
+		return err
+	}
+
+	m.ReceiverIDs = append(m.ReceiverIDs, uids...)
+
+	go broadcast(Event{Name: EventMessageDeleted, Data: m, ReceiverIDs: m.ReceiverIDs})
+
+	return nil
+}
+
+// MessageRevision is a previous content of an edited message.
+type MessageRevision struct {
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// GET /api/conversations/{conversation_id}/messages/{message_id}/revisions
+func getMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	cid := way.Param(ctx, "conversation_id")
+	mid := way.Param(ctx, "message_id")
+
+	if !isID(cid) || !isID(mid) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	isParticipant, err := queryParticipantExistance(ctx, tx, uid, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query participant existance: %w", err))
+		return
+	}
+
+	if !isParticipant {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT message_revisions.content, message_revisions.created_at
+		FROM message_revisions
+		INNER JOIN messages ON message_revisions.message_id = messages.id
+		WHERE message_revisions.message_id = $1
+			AND messages.conversation_id = $2
+		ORDER BY message_revisions.created_at DESC
+	`, mid, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query message revisions: %w", err))
+		return
+	}
+	defer rows.Close()
+
+	rr := make([]MessageRevision, 0)
+	for rows.Next() {
+		var rev MessageRevision
+		if err = rows.Scan(&rev.Content, &rev.CreatedAt); err != nil {
+			respondError(w, fmt.Errorf("could not scan message revision: %w", err))
+			return
+		}
+
+		rr = append(rr, rev)
+	}
+
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over message revisions: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to get message revisions: %w", err))
+		return
+	}
+
+	respond(w, rr, http.StatusOK)
+}
+
+// MessagesPage is a window of messages, newest first.
+type MessagesPage struct {
+	Messages      []Message `json:"messages"`
+	HasMoreBefore bool      `json:"hasMoreBefore"`
+	HasMoreAfter  bool      `json:"hasMoreAfter"`
+}
+
+// GET /api/conversations/{conversation_id}/messages?before={before}
+// GET /api/conversations/{conversation_id}/messages?after={after}
+// GET /api/conversations/{conversation_id}/messages?around={around}
+func getMessages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	before := strings.TrimSpace(q.Get("before"))
+	after := strings.TrimSpace(q.Get("after"))
+	around := strings.TrimSpace(q.Get("around"))
+
+	modes := 0
+	for _, v := range []string{before, after, around} {
+		if v != "" {
+			modes++
+		}
+	}
+	if modes > 1 {
+		respond(w, Errors{map[string]string{
+			"before": "Only one of before, after or around allowed",
+		}}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	for name, v := range map[string]string{"before": before, "after": after, "around": around} {
+		if v != "" && !isID(v) {
+			respond(w, Errors{map[string]string{
+				name: "Invalid message ID",
+			}}, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	cid := way.Param(ctx, "conversation_id")
+
+	if !isID(cid) {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	isParticipant, err := queryParticipantExistance(ctx, tx, uid, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query participant existance: %w", err))
 		return
 	}
 
-	f, ok := w.(http.Flusher)
-	if !ok {
-		respondError(w, errors.New("streaming unsupported"))
+	if !isParticipant {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	var page MessagesPage
+	switch {
+	case around != "":
+		var exists bool
+		if err = tx.QueryRowContext(ctx, `SELECT EXISTS (
+			SELECT 1 FROM messages WHERE id = $1 AND conversation_id = $2
+		)`, around, cid).Scan(&exists); err != nil {
+			respondError(w, fmt.Errorf("could not query message existance: %w", err))
+			return
+		}
+
+		if !exists {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+
+		half := messagesPageSize / 2
+		older, err := queryMessages(ctx, tx, uid, cid, "messages.id < $3", false, half+1, around)
+		if err != nil {
+			respondError(w, fmt.Errorf("could not query older messages: %w", err))
+			return
+		}
+
+		newer, err := queryMessages(ctx, tx, uid, cid, "messages.id >= $3", true, messagesPageSize-half+1, around)
+		if err != nil {
+			respondError(w, fmt.Errorf("could not query newer messages: %w", err))
+			return
+		}
+
+		if page.HasMoreBefore = len(older) > half; page.HasMoreBefore {
+			older = older[:half]
+		}
+		if page.HasMoreAfter = len(newer) > messagesPageSize-half; page.HasMoreAfter {
+			newer = newer[:messagesPageSize-half]
+		}
+
+		page.Messages = append(reverseMessages(newer), older...)
+	case after != "":
+		mm, err := queryMessages(ctx, tx, uid, cid, "messages.id > $3", true, messagesPageSize+1, after)
+		if err != nil {
+			respondError(w, fmt.Errorf("could not query messages: %w", err))
+			return
+		}
+
+		if page.HasMoreAfter = len(mm) > messagesPageSize; page.HasMoreAfter {
+			mm = mm[:messagesPageSize]
+		}
+
+		page.Messages = reverseMessages(mm)
+		page.HasMoreBefore = true
+	default:
+		var cond string
+		var args []interface{}
+		if before != "" {
+			cond = "messages.id < $3"
+			args = append(args, before)
+		}
+
+		mm, err := queryMessages(ctx, tx, uid, cid, cond, false, messagesPageSize+1, args...)
+		if err != nil {
+			respondError(w, fmt.Errorf("could not query messages: %w", err))
+			return
+		}
+
+		if page.HasMoreBefore = len(mm) > messagesPageSize; page.HasMoreBefore {
+			mm = mm[:messagesPageSize]
+		}
+
+		page.Messages = mm
+		page.HasMoreAfter = before != ""
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to get messages: %w", err))
 		return
 	}
 
+	// Only pages reaching the newest message read the conversation,
+	// and only up to what they loaded.
+	if !page.HasMoreAfter {
+		var upTo *time.Time
+		if len(page.Messages) != 0 {
+			upTo = &page.Messages[0].CreatedAt
+		}
+
+		go func() {
+			if err := updateMessagesReadAt(context.Background(), uid, cid, upTo); err != nil {
+				log.Printf("could not update messages read at: %v\n", err)
+			}
+		}()
+	}
+
+	respond(w, page, http.StatusOK)
+}
+
+func reverseMessages(mm []Message) []Message {
+	for i, j := 0, len(mm)-1; i < j; i, j = i+1, j-1 {
+		mm[i], mm[j] = mm[j], mm[i]
+	}
+	return mm
+}
+
+// GET /api/conversations/{conversation_id}/messages/{message_id}/replies?before={before}
+func getReplies(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	uid := ctx.Value(keyAuthUserID).(string)
+	cid := way.Param(ctx, "conversation_id")
+	mid := way.Param(ctx, "message_id")
+
+	if !isID(cid) || !isID(mid) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
 
-	h := w.Header()
-	h.Set("Cache-Control", "no-cache")
-	h.Set("Connection", "keep-alive")
-	h.Set("Content-Type", "text/event-stream")
+	defer func() { _ = tx.Rollback() }()
 
-	mm := make(chan Message)
-	defer close(mm)
+	isParticipant, err := queryParticipantExistance(ctx, tx, uid, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query participant existance: %w", err))
+		return
+	}
 
-	client := &MessageClient{Messages: mm, UserID: uid}
-	messageClients.Store(client, nil)
-	defer messageClients.Delete(client)
+	if !isParticipant {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
+	cond := "messages.reply_to_id = $3"
+	args := []interface{}{mid}
+	if before := strings.TrimSpace(r.URL.Query().Get("before")); before != "" {
+		if !isID(before) {
+			respond(w, Errors{map[string]string{
+				"before": "Invalid message ID",
+			}}, http.StatusUnprocessableEntity)
 			return
-		case m := <-mm:
-			if b, err := json.Marshal(m); err != nil {
-				log.Printf("could not marshall message: %v\n", err)
-				fmt.Fprintf(w, "event: error\ndata: %v\n\n", err)
-			} else {
-				fmt.Fprintf(w, "data: %s\n\n", b)
+		}
+
+		cond += " AND messages.id < $4"
+		args = append(args, before)
+	}
+
+	mm, err := queryMessages(ctx, tx, uid, cid, cond, false, messagesPageSize, args...)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query replies: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to get replies: %w", err))
+		return
+	}
+
+	respond(w, mm, http.StatusOK)
+}
+
+// queryMessages returns up to limit messages from the conversation visible to the user,
+// newest first unless oldestFirst is set.
+// An extra condition can be given; its placeholders start at $3.
+func queryMessages(ctx context.Context, tx *sql.Tx, uid, cid, cond string, oldestFirst bool, limit int, args ...interface{}) ([]Message, error) {
+	query := `
+		SELECT
+			messages.id,
+			messages.content,
+			messages.created_at,
+			messages.edited_at,
+			messages.user_id = $1 AS mine,
+			messages.system,
+			messages.reply_to_id,
+			users.id,
+			users.username,
+			users.avatar_url,
+			reply_to.content,
+			reply_to.deleted_at,
+			reply_to_users.id,
+			reply_to_users.username,
+			reply_to_users.avatar_url
+		FROM messages
+		INNER JOIN users ON messages.user_id = users.id
+		LEFT JOIN messages reply_to ON messages.reply_to_id = reply_to.id
+		LEFT JOIN users reply_to_users ON reply_to.user_id = reply_to_users.id
+		WHERE messages.conversation_id = $2
+			AND messages.deleted_at IS NULL
+			AND NOT EXISTS (
+				SELECT 1 FROM hidden_messages
+				WHERE hidden_messages.user_id = $1
+					AND hidden_messages.message_id = messages.id
+			)`
+	args = append([]interface{}{uid, cid}, args...)
+
+	if cond != "" {
+		query += " AND " + cond
+	}
+
+	order := "DESC"
+	if oldestFirst {
+		order = "ASC"
+	}
+
+	query += fmt.Sprintf(`
+		ORDER BY messages.created_at %s
+		LIMIT %d`, order, limit)
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	mm := make([]Message, 0, limit)
+	for rows.Next() {
+		var message Message
+		var u User
+		var replyToContent, replyToUserID, replyToUsername sql.NullString
+		var replyToDeletedAt sql.NullTime
+		var replyToAvatarURL *string
+		if err = rows.Scan(
+			&message.ID,
+			&message.Content,
+			&message.CreatedAt,
+			&message.EditedAt,
+			&message.Mine,
+			&message.System,
+			&message.ReplyToID,
+			&u.ID,
+			&u.Username,
+			&u.AvatarURL,
+			&replyToContent,
+			&replyToDeletedAt,
+			&replyToUserID,
+			&replyToUsername,
+			&replyToAvatarURL,
+		); err != nil {
+			return nil, fmt.Errorf("could not scan message: %w", err)
+		}
+
+		message.User = &u
+
+		if message.ReplyToID != nil && replyToUserID.Valid {
+			message.ReplyTo = &MessagePreview{
+				ID:      *message.ReplyToID,
+				Content: truncate(replyToContent.String, messagePreviewLength),
+				User: User{
+					ID:        replyToUserID.String,
+					Username:  replyToUsername.String,
+					AvatarURL: replyToAvatarURL,
+				},
 			}
-			f.Flush()
+			if replyToDeletedAt.Valid {
+				message.ReplyTo.DeletedAt = &replyToDeletedAt.Time
+			}
+		}
+
+		mm = append(mm, message)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not iterate over messages: %w", err)
+	}
+
+	mids := make([]string, len(mm))
+	var mineIDs []string
+	for i, m := range mm {
+		mids[i] = m.ID
+		if m.Mine && !m.System {
+			mineIDs = append(mineIDs, m.ID)
 		}
 	}
+
+	reactions, err := queryReactions(ctx, tx, uid, mids...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query messages reactions: %w", err)
+	}
+
+	attachments, err := queryAttachments(ctx, tx, mids...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query messages attachments: %w", err)
+	}
+
+	statuses, err := queryMessageStatuses(ctx, tx, mineIDs...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query messages statuses: %w", err)
+	}
+
+	for i, m := range mm {
+		mm[i].Reactions = reactions[m.ID]
+		mm[i].Attachments = attachments[m.ID]
+		mm[i].Status = statuses[m.ID]
+	}
+
+	return mm, nil
 }
 
 func readMessages(w http.ResponseWriter, r *http.Request) {
@@ -291,7 +1083,7 @@ func readMessages(w http.ResponseWriter, r *http.Request) {
 	uid := ctx.Value(keyAuthUserID).(string)
 	cid := way.Param(ctx, "conversation_id")
 
-	if err := updateMessagesReadAt(ctx, uid, cid); err != nil {
+	if err := updateMessagesReadAt(ctx, uid, cid, nil); err != nil {
 		respondError(w, fmt.Errorf("could not update messages read at: %w", err))
 		return
 	}
@@ -299,26 +1091,84 @@ func readMessages(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func updateMessagesReadAt(ctx context.Context, userID, cid string) error {
+// updateMessagesReadAt marks the messages of the conversation
+// created up to upTo as read, or all of them when nil.
+// The read time never goes back.
+func updateMessagesReadAt(ctx context.Context, userID, cid string, upTo *time.Time) error {
 	if ctx == nil {
 		ctx = context.Background()
 	}
 
-	if _, err := db.ExecContext(ctx, `
-		UPDATE participants SET messages_read_at = now()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin tx: %w", err)
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	var prevReadAt, readAt time.Time
+	if err = tx.QueryRowContext(ctx, `
+		SELECT messages_read_at FROM participants
 		WHERE user_id = $1 AND conversation_id = $2
-	`, userID, cid); err != nil {
+		FOR UPDATE
+	`, userID, cid).Scan(&prevReadAt); err == sql.ErrNoRows {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not query messages read at: %w", err)
+	}
+
+	if upTo != nil && !upTo.After(prevReadAt) {
+		return nil
+	}
+
+	// Messages after upTo stay unread.
+	if err = tx.QueryRowContext(ctx, `
+		UPDATE participants SET
+			messages_read_at = COALESCE($3, now()),
+			unread_messages_count = (
+				SELECT count(*) FROM messages
+				WHERE messages.conversation_id = $2
+					AND messages.user_id != $1
+					AND messages.system = false
+					AND messages.deleted_at IS NULL
+					AND messages.created_at > COALESCE($3, now())
+					AND NOT EXISTS (
+						SELECT 1 FROM hidden_messages
+						WHERE hidden_messages.user_id = $1
+							AND hidden_messages.message_id = messages.id
+					)
+			)
+		WHERE user_id = $1 AND conversation_id = $2
+		RETURNING messages_read_at
+	`, userID, cid, upTo).Scan(&readAt); err != nil {
+		return fmt.Errorf("could not update messages read at: %w", err)
+	}
+
+	ee, err := messagesRead(ctx, tx, userID, cid, prevReadAt, readAt)
+	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func broadcastMessage(m Message) {
-	messageClients.Range(func(key, _ interface{}) bool {
-		client := key.(*MessageClient)
-		if client.UserID == m.ReceiverID {
-			client.Messages <- m
-		}
-		return true
-	})
+	uids, err := queryParticipantIDs(ctx, tx, cid)
+	if err != nil {
+		return fmt.Errorf("could not query participant ids: %w", err)
+	}
+
+	ee = append(ee, Event{Name: EventParticipantRead, Data: ParticipantRead{
+		ConversationID: cid,
+		UserID:         userID,
+		ReadAt:         readAt,
+	}, ReceiverIDs: uids})
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit tx to update messages read at: %w", err)
+	}
+
+	for _, e := range ee {
+		go broadcast(e)
+	}
+
+	return nil
 }
@@ -0,0 +1,20 @@
+-- Moves the GitHub accounts linked through users.github_id
+-- into user_identities so existing users keep logging into the same account.
+-- Run once on databases created before user_identities existed:
+--   cat migrations/001_user_identities.sql | cockroach sql --insecure
+SET DATABASE = messenger;
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider STRING NOT NULL,
+    provider_user_id STRING NOT NULL,
+    user_id INT NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (provider, provider_user_id),
+    INDEX (user_id)
+);
+
+INSERT INTO user_identities (provider, provider_user_id, user_id)
+    SELECT 'github', github_id::STRING, id FROM users WHERE github_id IS NOT NULL
+    ON CONFLICT (provider, provider_user_id) DO NOTHING;
+
+ALTER TABLE users DROP COLUMN IF EXISTS github_id;
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	gonanoid "github.com/matoous/go-nanoid"
+	"github.com/matryer/way"
+	"golang.org/x/oauth2"
+)
+
+var errIdentityTaken = errors.New("identity linked to another user")
+
+// IdentityProvider users can log in with.
+type IdentityProvider interface {
+	// AuthCodeURL to send the user to.
+	AuthCodeURL(st oauthState) string
+	// Identity exchanges the code the user came back with
+	// for their identity at the provider.
+	Identity(ctx context.Context, code string, st oauthState) (ProviderIdentity, error)
+}
+
+// ProviderIdentity of a user at some identity provider.
+type ProviderIdentity struct {
+	// ID is stable and unique within the provider.
+	ID        string
+	Username  string
+	AvatarURL *string
+}
+
+// OAuthProvider registered under a name
+// that is also part of its URLs.
+type OAuthProvider struct {
+	Name  string `json:"name"`
+	Title string `json:"title"`
+
+	IdentityProvider `json:"-"`
+}
+
+// UserIdentity linked to a user.
+type UserIdentity struct {
+	Provider  string    `json:"provider"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// oauthState kept in a signed cookie in between the redirects.
+type oauthState struct {
+	State string
+	// Verifier is the PKCE code verifier.
+	Verifier string
+	// Nonce the ID token must come back with.
+	Nonce string
+	// LinkUserID is set when a logged in user links another provider.
+	LinkUserID string
+}
+
+// GithubUser data.
+type GithubUser struct {
+	ID        int     `json:"id"`
+	Login     string  `json:"login"`
+	AvatarURL *string `json:"avatar_url,omitempty"`
+}
+
+// GitHubProvider uses plain OAuth 2.0
+// since GitHub doesn't support OpenID Connect.
+type GitHubProvider struct {
+	Config oauth2.Config
+}
+
+// OIDCProvider works with any OpenID Connect provider
+// like GitLab, Google or a company one.
+// It uses PKCE and a nonce.
+// The ID token and the user come straight from the provider over TLS,
+// so the ID token signature is not checked, only its nonce and subject.
+type OIDCProvider struct {
+	Config      oauth2.Config
+	UserInfoURL string
+}
+
+var oauthProviders []OAuthProvider
+
+// registerOAuthProvider makes the provider available to log in with.
+func registerOAuthProvider(name, title string, p IdentityProvider) {
+	oauthProviders = append(oauthProviders, OAuthProvider{
+		Name:             name,
+		Title:            title,
+		IdentityProvider: p,
+	})
+}
+
+func oauthProvider(name string) (OAuthProvider, bool) {
+	for _, p := range oauthProviders {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return OAuthProvider{}, false
+}
+
+// oauthRedirectURL is where the provider sends the user back to.
+func oauthRedirectURL(name string) string {
+	u := cloneURL(origin)
+	u.Path = "/api/oauth/" + name + "/callback"
+	return u.String()
+}
+
+// GET /api/oauth_providers
+func getOAuthProviders(w http.ResponseWriter, r *http.Request) {
+	out := oauthProviders
+	if out == nil {
+		out = []OAuthProvider{}
+	}
+	respond(w, out, http.StatusOK)
+}
+
+// GET /api/oauth/{provider}
+func oauthStart(w http.ResponseWriter, r *http.Request) {
+	name := way.Param(r.Context(), "provider")
+	p, ok := oauthProvider(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var st oauthState
+
+	// Logged in users come with their token to link one more provider.
+	if requestToken(r) != "" {
+		uid, _, err := authenticate(r)
+		if err != nil {
+			respondError(w, fmt.Errorf("could not authenticate: %w", err))
+			return
+		}
+
+		if uid == "" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		st.LinkUserID = uid
+	}
+
+	var err error
+	st.State, err = gonanoid.Nanoid()
+	if err != nil {
+		respondError(w, fmt.Errorf("could not generte state: %w", err))
+		return
+	}
+
+	st.Nonce, err = gonanoid.Nanoid()
+	if err != nil {
+		respondError(w, fmt.Errorf("could not generate nonce: %w", err))
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		respondError(w, fmt.Errorf("could not generate code verifier: %w", err))
+		return
+	}
+
+	st.Verifier = base64.RawURLEncoding.EncodeToString(b)
+
+	stateCookieValue, err := cookieSigner.Encode("state", st)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not encode state cookie: %w", err))
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "state",
+		Value:    stateCookieValue,
+		Path:     "/api/oauth/" + name,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, p.AuthCodeURL(st), http.StatusTemporaryRedirect)
+}
+
+// GET /api/oauth/{provider}/callback
+func oauthCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := way.Param(ctx, "provider")
+	p, ok := oauthProvider(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	stateCookie, err := r.Cookie("state")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusTeapot), http.StatusTeapot)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "state", Value: "", Path: "/api/oauth/" + name, MaxAge: -1})
+
+	var st oauthState
+	if err = cookieSigner.Decode("state", stateCookie.Value, &st); err != nil {
+		http.Error(w, http.StatusText(http.StatusTeapot), http.StatusTeapot)
+		return
+	}
+
+	q := r.URL.Query()
+
+	if st.State != q.Get("state") {
+		http.Error(w, http.StatusText(http.StatusTeapot), http.StatusTeapot)
+		return
+	}
+
+	if q.Get("error") != "" {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	identity, err := p.Identity(ctx, q.Get("code"), st)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not fetch %s identity: %w", name, err))
+		return
+	}
+
+	if st.LinkUserID != "" {
+		err = linkIdentity(ctx, st.LinkUserID, name, identity)
+		if err == errIdentityTaken {
+			http.Error(w, "Account already linked to another user", http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			respondError(w, fmt.Errorf("could not link %s identity: %w", name, err))
+			return
+		}
+
+		http.Redirect(w, r, origin.String(), http.StatusTemporaryRedirect)
+		return
+	}
+
+	uid, err := identityUser(ctx, name, identity)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query %s identity user: %w", name, err))
+		return
+	}
+
+	redirectWithSession(w, r, uid)
+}
+
+// GET /api/identities
+func getIdentities(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT provider, created_at FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, uid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query identities: %w", err))
+		return
+	}
+
+	defer rows.Close()
+
+	ii := make([]UserIdentity, 0)
+	for rows.Next() {
+		var i UserIdentity
+		if err = rows.Scan(&i.Provider, &i.CreatedAt); err != nil {
+			respondError(w, fmt.Errorf("could not scan identity: %w", err))
+			return
+		}
+
+		i.Title = i.Provider
+		if p, ok := oauthProvider(i.Provider); ok {
+			i.Title = p.Title
+		}
+		ii = append(ii, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over identities: %w", err))
+		return
+	}
+
+	respond(w, ii, http.StatusOK)
+}
+
+// DELETE /api/identities/{provider}
+func unlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	provider := way.Param(ctx, "provider")
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	var linked, found int
+	if err = tx.QueryRowContext(ctx, `
+		SELECT count(*), count(CASE WHEN provider = $2 THEN 1 END)
+		FROM user_identities WHERE user_id = $1
+	`, uid, provider).Scan(&linked, &found); err != nil {
+		respondError(w, fmt.Errorf("could not count identities: %w", err))
+		return
+	}
+
+	if found == 0 {
+		http.Error(w, "Identity not found", http.StatusNotFound)
+		return
+	}
+
+	if linked <= 1 {
+		respond(w, Errors{map[string]string{
+			"provider": "Can't unlink your only way to log in",
+		}}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		DELETE FROM user_identities WHERE user_id = $1 AND provider = $2
+	`, uid, provider); err != nil {
+		respondError(w, fmt.Errorf("could not delete identity: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to unlink identity: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redirectWithSession starts a new session for the user
+// and sends them to the frontend with its tokens in the URL fragment.
+// Users with two-factor authentication are sent
+// to finish logging in with a code instead.
+func redirectWithSession(w http.ResponseWriter, r *http.Request, uid string) {
+	ctx := r.Context()
+
+	challenge, err := twoFactorChallenge(ctx, uid)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	if challenge != "" {
+		twoFactorURL := cloneURL(origin)
+		twoFactorURL.Path = "/two-factor"
+		twoFactorURL.RawQuery = url.Values{"token": {challenge}}.Encode()
+		http.Redirect(w, r, twoFactorURL.String(), http.StatusTemporaryRedirect)
+		return
+	}
+
+	tokens, err := startSession(ctx, uid, r.UserAgent(), clientIP(r))
+	if err != nil {
+		respondError(w, fmt.Errorf("could not start session: %w", err))
+		return
+	}
+
+	data := make(url.Values)
+	data.Set("token", tokens.Token)
+	data.Set("expires_at", tokens.ExpiresAt.Format(time.RFC3339Nano))
+	data.Set("refresh_token", tokens.RefreshToken)
+	data.Set("refresh_token_expires_at", tokens.RefreshTokenExpiresAt.Format(time.RFC3339Nano))
+
+	callbackURL := cloneURL(origin)
+	callbackURL.Path = "/callback"
+
+	// In the fragment so the tokens stay out of server logs and Referer headers.
+	http.Redirect(w, r, callbackURL.String()+"#"+data.Encode(), http.StatusTemporaryRedirect)
+}
+
+// identityUser returns the ID of the user with that identity,
+// creating the user on first login.
+func identityUser(ctx context.Context, provider string, identity ProviderIdentity) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not begin tx: %w", err)
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	uid, err := queryIdentityUser(ctx, tx, provider, identity)
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", fmt.Errorf("could not commit tx to query identity user: %w", err)
+	}
+
+	return uid, nil
+}
+
+// queryIdentityUser is identityUser inside the given transaction.
+func queryIdentityUser(ctx context.Context, tx *sql.Tx, provider string, identity ProviderIdentity) (string, error) {
+	var uid string
+	if err := tx.QueryRowContext(ctx, `
+		SELECT user_id FROM user_identities WHERE provider = $1 AND provider_user_id = $2
+	`, provider, identity.ID).Scan(&uid); err == sql.ErrNoRows {
+		if uid, err = insertUser(ctx, tx, identity.Username, identity.AvatarURL); err != nil {
+			return "", fmt.Errorf("could not insert user: %w", err)
+		}
+
+		if _, err = tx.ExecContext(ctx, `
+			INSERT INTO user_identities (provider, provider_user_id, user_id) VALUES ($1, $2, $3)
+		`, provider, identity.ID, uid); err != nil {
+			return "", fmt.Errorf("could not insert identity: %w", err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("could not query identity: %w", err)
+	}
+
+	return uid, nil
+}
+
+// linkIdentity adds the identity to the user.
+// Linking one already linked to the same user is a no-op.
+func linkIdentity(ctx context.Context, uid, provider string, identity ProviderIdentity) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin tx: %w", err)
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	var ownerID string
+	if err = tx.QueryRowContext(ctx, `
+		SELECT user_id FROM user_identities WHERE provider = $1 AND provider_user_id = $2
+	`, provider, identity.ID).Scan(&ownerID); err == sql.ErrNoRows {
+		if _, err = tx.ExecContext(ctx, `
+			INSERT INTO user_identities (provider, provider_user_id, user_id) VALUES ($1, $2, $3)
+		`, provider, identity.ID, uid); err != nil {
+			return fmt.Errorf("could not insert identity: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("could not query identity: %w", err)
+	} else if ownerID != uid {
+		return errIdentityTaken
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit tx to link identity: %w", err)
+	}
+
+	return nil
+}
+
+// AuthCodeURL to GitHub.
+func (p GitHubProvider) AuthCodeURL(st oauthState) string {
+	return p.Config.AuthCodeURL(st.State)
+}
+
+// Identity fetches the GitHub user.
+func (p GitHubProvider) Identity(ctx context.Context, code string, _ oauthState) (ProviderIdentity, error) {
+	t, err := p.Config.Exchange(ctx, code)
+	if err != nil {
+		return ProviderIdentity{}, fmt.Errorf("could not fetch token: %w", err)
+	}
+
+	resp, err := p.Config.Client(ctx, t).Get("https://api.github.com/user")
+	if err != nil {
+		return ProviderIdentity{}, fmt.Errorf("could not fetch user: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ProviderIdentity{}, fmt.Errorf("could not fetch user: unexpected status code %d", resp.StatusCode)
+	}
+
+	var githubUser GithubUser
+	if err = json.NewDecoder(resp.Body).Decode(&githubUser); err != nil {
+		return ProviderIdentity{}, fmt.Errorf("could not decode user: %w", err)
+	}
+
+	return ProviderIdentity{
+		ID:        strconv.Itoa(githubUser.ID),
+		Username:  githubUser.Login,
+		AvatarURL: githubUser.AvatarURL,
+	}, nil
+}
+
+// discoverOIDCProvider sets up the provider
+// with the endpoints from the discovery document of the issuer.
+// Scopes default to openid, profile and email.
+func discoverOIDCProvider(ctx context.Context, issuer string, config oauth2.Config) (OIDCProvider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return OIDCProvider{}, fmt.Errorf("could not create discovery request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return OIDCProvider{}, fmt.Errorf("could not fetch discovery document: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return OIDCProvider{}, fmt.Errorf("could not fetch discovery document: unexpected status code %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return OIDCProvider{}, fmt.Errorf("could not decode discovery document: %w", err)
+	}
+
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return OIDCProvider{}, fmt.Errorf("discovery document issuer %q does not match %q", doc.Issuer, issuer)
+	}
+
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.UserinfoEndpoint == "" {
+		return OIDCProvider{}, errors.New("discovery document is missing endpoints")
+	}
+
+	config.Endpoint = oauth2.Endpoint{
+		AuthURL:  doc.AuthorizationEndpoint,
+		TokenURL: doc.TokenEndpoint,
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+
+	return OIDCProvider{Config: config, UserInfoURL: doc.UserinfoEndpoint}, nil
+}
+
+// AuthCodeURL to the OpenID Connect provider.
+func (p OIDCProvider) AuthCodeURL(st oauthState) string {
+	return p.Config.AuthCodeURL(st.State,
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(st.Verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		oauth2.SetAuthURLParam("nonce", st.Nonce),
+	)
+}
+
+// Identity fetches the user info.
+// The username is the first of preferred username, nickname,
+// the local part of the email or the name that is set.
+func (p OIDCProvider) Identity(ctx context.Context, code string, st oauthState) (ProviderIdentity, error) {
+	t, err := p.Config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", st.Verifier))
+	if err != nil {
+		return ProviderIdentity{}, fmt.Errorf("could not fetch token: %w", err)
+	}
+
+	rawIDToken, _ := t.Extra("id_token").(string)
+	claims, err := parseIDToken(rawIDToken)
+	if err != nil {
+		return ProviderIdentity{}, err
+	}
+
+	if claims.Nonce == "" || claims.Nonce != st.Nonce {
+		return ProviderIdentity{}, errors.New("id token nonce does not match")
+	}
+
+	resp, err := p.Config.Client(ctx, t).Get(p.UserInfoURL)
+	if err != nil {
+		return ProviderIdentity{}, fmt.Errorf("could not fetch user info: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ProviderIdentity{}, fmt.Errorf("could not fetch user info: unexpected status code %d", resp.StatusCode)
+	}
+
+	var info struct {
+		Subject           string  `json:"sub"`
+		PreferredUsername string  `json:"preferred_username"`
+		Nickname          string  `json:"nickname"`
+		Email             string  `json:"email"`
+		Name              string  `json:"name"`
+		Picture           *string `json:"picture"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return ProviderIdentity{}, fmt.Errorf("could not decode user info: %w", err)
+	}
+
+	if info.Subject == "" {
+		return ProviderIdentity{}, errors.New("user info is missing subject")
+	}
+
+	if info.Subject != claims.Subject {
+		return ProviderIdentity{}, errors.New("user info subject does not match the id token")
+	}
+
+	var username string
+	for _, s := range []string{
+		info.PreferredUsername,
+		info.Nickname,
+		strings.SplitN(info.Email, "@", 2)[0],
+		info.Name,
+	} {
+		if s = strings.TrimSpace(s); s != "" {
+			username = rxSpaces.ReplaceAllString(s, "_")
+			break
+		}
+	}
+
+	if info.Picture != nil && *info.Picture == "" {
+		info.Picture = nil
+	}
+
+	return ProviderIdentity{
+		ID:        info.Subject,
+		Username:  username,
+		AvatarURL: info.Picture,
+	}, nil
+}
+
+// idTokenClaims checked to tie the ID token to the login.
+type idTokenClaims struct {
+	Subject string `json:"sub"`
+	Nonce   string `json:"nonce"`
+}
+
+// parseIDToken decodes the claims of the ID token without checking its signature.
+func parseIDToken(raw string) (idTokenClaims, error) {
+	var claims idTokenClaims
+
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("token response is missing a valid id token")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, fmt.Errorf("could not decode id token: %w", err)
+	}
+
+	if err = json.Unmarshal(b, &claims); err != nil {
+		return claims, fmt.Errorf("could not unmarshal id token claims: %w", err)
+	}
+
+	return claims, nil
+}
+
+// pkceChallenge derives the S256 code challenge from the verifier.
+func pkceChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// mockOIDCServer serves the discovery, token and userinfo endpoints
+// of an OpenID Connect issuer.
+// The authorization request is not served, pass its URL to authorize instead.
+type mockOIDCServer struct {
+	*httptest.Server
+	challenge string
+	nonce     string
+}
+
+// newMockOIDCServer with a discovery document announcing
+// the given issuer, or the server URL if empty.
+func newMockOIDCServer(t *testing.T, issuer string, userInfo map[string]interface{}) *mockOIDCServer {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	srv := &mockOIDCServer{Server: httptest.NewServer(mux)}
+	t.Cleanup(srv.Close)
+
+	if issuer == "" {
+		issuer = srv.URL
+	}
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"userinfo_endpoint":      srv.URL + "/userinfo",
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("code") != "test-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		h := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(h[:]) != srv.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss":   issuer,
+			"sub":   userInfo["sub"],
+			"aud":   "client",
+			"nonce": srv.nonce,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "test-access-token",
+			"token_type":   "Bearer",
+			"id_token": base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+				base64.RawURLEncoding.EncodeToString(claims) + ".",
+		})
+	})
+
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-access-token" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(userInfo)
+	})
+
+	return srv
+}
+
+// authorize plays the provider receiving the user at the auth code URL,
+// keeping the PKCE challenge and nonce for the token endpoint.
+func (srv *mockOIDCServer) authorize(t *testing.T, authCodeURL string) {
+	t.Helper()
+
+	u, err := url.Parse(authCodeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := u.Query()
+	if got := q.Get("code_challenge_method"); got != "S256" {
+		t.Fatalf("code_challenge_method = %q, want S256", got)
+	}
+
+	srv.challenge = q.Get("code_challenge")
+	srv.nonce = q.Get("nonce")
+	if srv.challenge == "" || srv.nonce == "" {
+		t.Fatalf("auth code URL %s is missing the code challenge or nonce", authCodeURL)
+	}
+}
+
+// testOAuthState like the one oauthStart saves.
+var testOAuthState = oauthState{
+	State:    "test-state",
+	Verifier: "test-verifier-with-enough-characters-to-be-valid",
+	Nonce:    "test-nonce",
+}
+
+func TestDiscoverOIDCProvider(t *testing.T) {
+	srv := newMockOIDCServer(t, "", nil)
+
+	p, err := discoverOIDCProvider(context.Background(), srv.URL+"/", oauth2.Config{ClientID: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Config.Endpoint.AuthURL != srv.URL+"/authorize" {
+		t.Errorf("AuthURL = %q", p.Config.Endpoint.AuthURL)
+	}
+	if p.Config.Endpoint.TokenURL != srv.URL+"/token" {
+		t.Errorf("TokenURL = %q", p.Config.Endpoint.TokenURL)
+	}
+	if p.UserInfoURL != srv.URL+"/userinfo" {
+		t.Errorf("UserInfoURL = %q", p.UserInfoURL)
+	}
+	if got := strings.Join(p.Config.Scopes, " "); got != "openid profile email" {
+		t.Errorf("Scopes = %q", got)
+	}
+}
+
+func TestDiscoverOIDCProviderIssuerMismatch(t *testing.T) {
+	srv := newMockOIDCServer(t, "https://evil.example.org", nil)
+
+	_, err := discoverOIDCProvider(context.Background(), srv.URL, oauth2.Config{})
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("err = %v, want issuer mismatch", err)
+	}
+}
+
+func TestOIDCProviderIdentity(t *testing.T) {
+	tt := []struct {
+		name      string
+		userInfo  map[string]interface{}
+		want      ProviderIdentity
+		wantError string
+	}{
+		{
+			name: "preferred_username",
+			userInfo: map[string]interface{}{
+				"sub":                "123",
+				"preferred_username": "alice",
+				"nickname":           "al",
+				"picture":            "https://example.org/alice.png",
+			},
+			want: ProviderIdentity{ID: "123", Username: "alice", AvatarURL: strPtr("https://example.org/alice.png")},
+		},
+		{
+			name:     "nickname",
+			userInfo: map[string]interface{}{"sub": "123", "nickname": "al", "email": "alice@example.org"},
+			want:     ProviderIdentity{ID: "123", Username: "al"},
+		},
+		{
+			name:     "email",
+			userInfo: map[string]interface{}{"sub": "123", "email": "alice@example.org", "name": "Alice"},
+			want:     ProviderIdentity{ID: "123", Username: "alice"},
+		},
+		{
+			name:     "name",
+			userInfo: map[string]interface{}{"sub": "123", "name": "Alice  Liddell", "picture": ""},
+			want:     ProviderIdentity{ID: "123", Username: "Alice_Liddell"},
+		},
+		{
+			name:      "missing sub",
+			userInfo:  map[string]interface{}{"preferred_username": "alice"},
+			wantError: "missing subject",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newMockOIDCServer(t, "", tc.userInfo)
+
+			ctx := context.Background()
+			p, err := discoverOIDCProvider(ctx, srv.URL, oauth2.Config{ClientID: "client", ClientSecret: "secret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			srv.authorize(t, p.AuthCodeURL(testOAuthState))
+
+			got, err := p.Identity(ctx, "test-code", testOAuthState)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("err = %v, want %q", err, tc.wantError)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.ID != tc.want.ID || got.Username != tc.want.Username {
+				t.Errorf("Identity() = %+v, want %+v", got, tc.want)
+			}
+
+			if (got.AvatarURL == nil) != (tc.want.AvatarURL == nil) ||
+				got.AvatarURL != nil && *got.AvatarURL != *tc.want.AvatarURL {
+				t.Errorf("AvatarURL = %v, want %v", got.AvatarURL, tc.want.AvatarURL)
+			}
+		})
+	}
+}
+
+func TestOIDCProviderIdentityPKCE(t *testing.T) {
+	srv := newMockOIDCServer(t, "", map[string]interface{}{"sub": "123", "nickname": "al"})
+
+	ctx := context.Background()
+	p, err := discoverOIDCProvider(ctx, srv.URL, oauth2.Config{ClientID: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.authorize(t, p.AuthCodeURL(testOAuthState))
+
+	st := testOAuthState
+	st.Verifier = "another-verifier-with-enough-characters-to-be-valid"
+	if _, err = p.Identity(ctx, "test-code", st); err == nil || !strings.Contains(err.Error(), "could not fetch token") {
+		t.Errorf("err = %v, want token error for another verifier", err)
+	}
+}
+
+func TestOIDCProviderIdentityNonceMismatch(t *testing.T) {
+	srv := newMockOIDCServer(t, "", map[string]interface{}{"sub": "123", "nickname": "al"})
+
+	ctx := context.Background()
+	p, err := discoverOIDCProvider(ctx, srv.URL, oauth2.Config{ClientID: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.authorize(t, p.AuthCodeURL(testOAuthState))
+
+	st := testOAuthState
+	st.Nonce = "another-nonce"
+	if _, err = p.Identity(ctx, "test-code", st); err == nil || !strings.Contains(err.Error(), "nonce does not match") {
+		t.Errorf("err = %v, want nonce mismatch", err)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
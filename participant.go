@@ -3,14 +3,26 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/matryer/way"
 )
 
-// GET /api/conversations/{conversation_id}/other_participant
-func getOtherParticipantFromConversation(w http.ResponseWriter, r *http.Request) {
+// ParticipantRead sent through the realtime stream
+// when someone reads a conversation.
+type ParticipantRead struct {
+	ConversationID string    `json:"conversationId"`
+	UserID         string    `json:"userId"`
+	ReadAt         time.Time `json:"readAt"`
+}
+
+// GET /api/conversations/{conversation_id}/participants
+func getParticipants(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	uid := ctx.Value(keyAuthUserID).(string)
 	cid := way.Param(ctx, "conversation_id")
@@ -34,35 +46,363 @@ func getOtherParticipantFromConversation(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var otherUser User
+	participants, err := queryParticipants(ctx, tx, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query participants from conversation: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to get participants from conversation: %w", err))
+		return
+	}
+
+	uu, ok := participants[cid]
+	if !ok {
+		uu = make([]User, 0)
+	}
+
+	respond(w, uu, http.StatusOK)
+}
+
+// POST /api/conversations/{conversation_id}/participants
+func addParticipant(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	in.Username = strings.TrimSpace(in.Username)
+	if in.Username == "" {
+		respond(w, Errors{map[string]string{
+			"username": "Username required",
+		}}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	cid := way.Param(ctx, "conversation_id")
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	isParticipant, err := queryParticipantExistance(ctx, tx, uid, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query participant existance: %w", err))
+		return
+	}
+
+	if !isParticipant {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	var participantsCount int
 	if err = tx.QueryRowContext(ctx, `
-		SELECT
-			users.id,
-			users.username,
-			users.avatar_url
-		FROM participants
-		INNER JOIN users ON participants.user_id = users.id
-		WHERE participants.user_id != $1
-			AND participants.conversation_id = $2
-		LIMIT 1
-	`, uid, cid).Scan(
-		&otherUser.ID,
-		&otherUser.Username,
-		&otherUser.AvatarURL,
-	); err == sql.ErrNoRows {
-		http.Error(w, "Could not find the other participant of this conversation", http.StatusNotFound)
+		SELECT count(*) FROM participants WHERE conversation_id = $1
+	`, cid).Scan(&participantsCount); err != nil {
+		respondError(w, fmt.Errorf("could not count participants: %w", err))
+		return
+	}
+
+	if participantsCount >= maxConversationParticipants {
+		http.Error(w, "Conversation is full", http.StatusForbidden)
+		return
+	}
+
+	var user User
+	if err = tx.QueryRowContext(ctx, `
+		SELECT id, username, avatar_url FROM users WHERE username = $1
+	`, in.Username).Scan(&user.ID, &user.Username, &user.AvatarURL); err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	} else if err != nil {
-		respondError(w, fmt.Errorf("could not query other participant from conversation: %w", err))
+		respondError(w, fmt.Errorf("could not query user: %w", err))
+		return
+	}
+
+	alreadyParticipant, err := queryParticipantExistance(ctx, tx, user.ID, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query participant existance: %w", err))
+		return
+	}
+
+	if alreadyParticipant {
+		http.Error(w, "User already in conversation", http.StatusConflict)
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		INSERT INTO participants (user_id, conversation_id) VALUES ($1, $2)
+	`, user.ID, cid); err != nil {
+		respondError(w, fmt.Errorf("could not insert participant: %w", err))
+		return
+	}
+
+	authUser, err := queryUser(ctx, tx, uid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query auth user: %w", err))
+		return
+	}
+
+	m, err := insertMessage(ctx, tx, Message{
+		Content:        authUser.Username + " added " + user.Username,
+		UserID:         uid,
+		ConversationID: cid,
+		System:         true,
+	})
+	if err != nil {
+		respondError(w, fmt.Errorf("could not insert system message: %w", err))
 		return
 	}
 
 	if err = tx.Commit(); err != nil {
-		respondError(w, fmt.Errorf("could not commit tx to get other participant from conversation: %w", err))
+		respondError(w, fmt.Errorf("could not commit tx to add participant: %w", err))
 		return
 	}
 
-	respond(w, otherUser, http.StatusOK)
+	go func() {
+		if err := messageCreated(m); err != nil {
+			log.Printf("failed to do message created afterwork: %v\n", err)
+		}
+	}()
+
+	go func() {
+		if err := conversationUpdated(cid); err != nil {
+			log.Printf("failed to do conversation updated afterwork: %v\n", err)
+		}
+	}()
+
+	respond(w, user, http.StatusCreated)
+}
+
+// DELETE /api/conversations/{conversation_id}/participants/{user_id}
+func removeParticipant(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	cid := way.Param(ctx, "conversation_id")
+	userID := way.Param(ctx, "user_id")
+
+	if !isID(userID) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if userID == uid {
+		http.Error(w, "Leave the conversation instead", http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	var isAdmin bool
+	if err = tx.QueryRowContext(ctx, `
+		SELECT is_admin FROM participants
+		WHERE user_id = $1 AND conversation_id = $2
+	`, uid, cid).Scan(&isAdmin); err == sql.ErrNoRows {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query participant: %w", err))
+		return
+	}
+
+	if !isAdmin {
+		http.Error(w, "Only conversation admins can remove participants", http.StatusForbidden)
+		return
+	}
+
+	user, err := queryUser(ctx, tx, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query user: %w", err))
+		return
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM participants
+		WHERE user_id = $1 AND conversation_id = $2
+	`, userID, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not delete participant: %w", err))
+		return
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		respondError(w, fmt.Errorf("could not get deleted participants count: %w", err))
+		return
+	} else if n == 0 {
+		http.Error(w, "Participant not found", http.StatusNotFound)
+		return
+	}
+
+	authUser, err := queryUser(ctx, tx, uid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query auth user: %w", err))
+		return
+	}
+
+	m, err := insertMessage(ctx, tx, Message{
+		Content:        authUser.Username + " removed " + user.Username,
+		UserID:         uid,
+		ConversationID: cid,
+		System:         true,
+	})
+	if err != nil {
+		respondError(w, fmt.Errorf("could not insert system message: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to remove participant: %w", err))
+		return
+	}
+
+	m.ReceiverIDs = []string{userID}
+	go func() {
+		if err := messageCreated(m); err != nil {
+			log.Printf("failed to do message created afterwork: %v\n", err)
+		}
+	}()
+
+	go func() {
+		if err := conversationUpdated(cid, userID); err != nil {
+			log.Printf("failed to do conversation updated afterwork: %v\n", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/conversations/{conversation_id}/leave
+func leaveConversation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	cid := way.Param(ctx, "conversation_id")
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	var wasAdmin bool
+	if err = tx.QueryRowContext(ctx, `
+		DELETE FROM participants
+		WHERE user_id = $1 AND conversation_id = $2
+		RETURNING is_admin
+	`, uid, cid).Scan(&wasAdmin); err == sql.ErrNoRows {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not delete participant: %w", err))
+		return
+	}
+
+	var participantsCount int
+	if err = tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM participants WHERE conversation_id = $1
+	`, cid).Scan(&participantsCount); err != nil {
+		respondError(w, fmt.Errorf("could not count participants: %w", err))
+		return
+	}
+
+	// Nobody left to read it.
+	if participantsCount == 0 {
+		if _, err = tx.ExecContext(ctx, `DELETE FROM conversations WHERE id = $1`, cid); err != nil {
+			respondError(w, fmt.Errorf("could not delete empty conversation: %w", err))
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			respondError(w, fmt.Errorf("could not commit tx to leave conversation: %w", err))
+			return
+		}
+
+		go func() {
+			if err := conversationUpdated(cid, uid); err != nil {
+				log.Printf("failed to do conversation updated afterwork: %v\n", err)
+			}
+		}()
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Make sure the conversation keeps at least one admin.
+	if wasAdmin {
+		if _, err = tx.ExecContext(ctx, `
+			UPDATE participants SET is_admin = true
+			WHERE conversation_id = $1
+				AND user_id = (
+					SELECT user_id FROM participants
+					WHERE conversation_id = $1
+					ORDER BY is_admin DESC, user_id
+					LIMIT 1
+				)
+		`, cid); err != nil {
+			respondError(w, fmt.Errorf("could not promote new admin: %w", err))
+			return
+		}
+	}
+
+	authUser, err := queryUser(ctx, tx, uid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query auth user: %w", err))
+		return
+	}
+
+	m, err := insertMessage(ctx, tx, Message{
+		Content:        authUser.Username + " left",
+		UserID:         uid,
+		ConversationID: cid,
+		System:         true,
+	})
+	if err != nil {
+		respondError(w, fmt.Errorf("could not insert system message: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to leave conversation: %w", err))
+		return
+	}
+
+	// The user's other devices get it too.
+	m.ReceiverIDs = []string{uid}
+	go func() {
+		if err := messageCreated(m); err != nil {
+			log.Printf("failed to do message created afterwork: %v\n", err)
+		}
+	}()
+
+	go func() {
+		if err := conversationUpdated(cid, uid); err != nil {
+			log.Printf("failed to do conversation updated afterwork: %v\n", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func queryParticipantExistance(ctx context.Context, tx *sql.Tx, userID, cid string) (bool, error) {
@@ -78,3 +418,88 @@ func queryParticipantExistance(ctx context.Context, tx *sql.Tx, userID, cid stri
 	}
 	return exists, nil
 }
+
+// queryParticipants returns the participants of each of the given
+// conversations keyed by conversation ID.
+func queryParticipants(ctx context.Context, querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}, cids ...string) (map[string][]User, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	out := make(map[string][]User, len(cids))
+	if len(cids) == 0 {
+		return out, nil
+	}
+
+	rows, err := querier.QueryContext(ctx, `
+		SELECT
+			participants.conversation_id,
+			users.id,
+			users.username,
+			users.avatar_url,
+			users.last_seen_at,
+			users.hide_last_seen,
+			EXISTS (
+				SELECT 1 FROM online_users
+				INNER JOIN instances ON online_users.instance_id = instances.id
+				WHERE online_users.user_id = users.id AND instances.expires_at > now()
+			)
+		FROM participants
+		INNER JOIN users ON participants.user_id = users.id
+		WHERE participants.conversation_id = ANY($1)
+		ORDER BY users.username
+	`, cids)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid string
+		var u User
+		var lastSeenAt *time.Time
+		var hideLastSeen, onlineElsewhere bool
+		if err = rows.Scan(&cid, &u.ID, &u.Username, &u.AvatarURL, &lastSeenAt, &hideLastSeen, &onlineElsewhere); err != nil {
+			return nil, err
+		}
+
+		u.Presence = presenceOf(isOnlineHere(u.ID) || onlineElsewhere, lastSeenAt, hideLastSeen)
+
+		out[cid] = append(out[cid], u)
+	}
+
+	return out, rows.Err()
+}
+
+// queryParticipantIDs returns the user IDs of the participants of a conversation.
+func queryParticipantIDs(ctx context.Context, querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}, cid string) ([]string, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	rows, err := querier.QueryContext(ctx, `
+		SELECT user_id FROM participants WHERE conversation_id = $1
+	`, cid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var uids []string
+	for rows.Next() {
+		var uid string
+		if err = rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+
+		uids = append(uids, uid)
+	}
+
+	return uids, rows.Err()
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// presenceHeartbeatInterval is how often each instance
+	// tells the others it's still alive.
+	presenceHeartbeatInterval = time.Second * 10
+	// presenceInstanceTTL after which the users of an instance
+	// that stopped sending heartbeats are no longer online.
+	presenceInstanceTTL = time.Second * 30
+)
+
+// Presence of a user.
+// Users are online while they hold at least one realtime stream.
+type Presence struct {
+	Online     bool       `json:"online"`
+	LastSeenAt *time.Time `json:"lastSeenAt,omitempty"`
+}
+
+// PresenceChange sent through the realtime stream to the users
+// sharing a conversation with someone that went online or offline.
+type PresenceChange struct {
+	UserID string `json:"userId"`
+	Presence
+}
+
+// sharedPresence is set when running many instances.
+// Then each one records its online users in the database
+// so the others know about them.
+var sharedPresence bool
+
+// instanceID identifies this instance in the shared presence.
+var instanceID string
+
+// presenceSyncMu keeps the shared presence writes of this instance in order
+// so the last one always reflects the latest stream count.
+var presenceSyncMu sync.Mutex
+
+// onlineUsers counts the realtime streams of each user
+// connected to this instance.
+var onlineUsers = struct {
+	sync.Mutex
+	streams map[string]int
+}{
+	streams: make(map[string]int),
+}
+
+// userConnected registers a new stream of the user
+// and reports whether it's the first one.
+func userConnected(uid string) bool {
+	onlineUsers.Lock()
+	defer onlineUsers.Unlock()
+
+	onlineUsers.streams[uid]++
+	return onlineUsers.streams[uid] == 1
+}
+
+// userDisconnected unregisters a stream of the user
+// and reports whether it was the last one.
+func userDisconnected(uid string) bool {
+	onlineUsers.Lock()
+	defer onlineUsers.Unlock()
+
+	onlineUsers.streams[uid]--
+	if onlineUsers.streams[uid] > 0 {
+		return false
+	}
+
+	delete(onlineUsers.streams, uid)
+	return true
+}
+
+func isOnlineHere(uid string) bool {
+	onlineUsers.Lock()
+	defer onlineUsers.Unlock()
+
+	return onlineUsers.streams[uid] > 0
+}
+
+// isOnline reports whether the user has streams on any instance.
+func isOnline(uid string) bool {
+	if isOnlineHere(uid) {
+		return true
+	}
+
+	if !sharedPresence {
+		return false
+	}
+
+	var online bool
+	if err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM online_users
+			INNER JOIN instances ON online_users.instance_id = instances.id
+			WHERE online_users.user_id = $1 AND instances.expires_at > now()
+		)
+	`, uid).Scan(&online); err != nil {
+		log.Printf("could not query shared presence: %v\n", err)
+		return false
+	}
+
+	return online
+}
+
+// presenceOf builds the presence of the user
+// out of its persisted last seen time and privacy setting.
+func presenceOf(online bool, lastSeenAt *time.Time, hideLastSeen bool) *Presence {
+	p := &Presence{Online: online}
+	if !p.Online && !hideLastSeen {
+		p.LastSeenAt = lastSeenAt
+	}
+	return p
+}
+
+// startPresenceHeartbeat registers this instance in the shared presence
+// and keeps it alive, removing the instances that stopped.
+// Users connected to an instance that crashed just stop being online
+// without their contacts being notified.
+func startPresenceHeartbeat() error {
+	heartbeat := func() error {
+		if _, err := db.Exec(`
+			UPSERT INTO instances (id, expires_at) VALUES ($1, now() + $2 * INTERVAL '1 second')
+		`, instanceID, int(presenceInstanceTTL.Seconds())); err != nil {
+			return fmt.Errorf("could not upsert instance: %w", err)
+		}
+
+		if _, err := db.Exec(`DELETE FROM instances WHERE expires_at < now()`); err != nil {
+			return fmt.Errorf("could not delete expired instances: %w", err)
+		}
+
+		if _, err := db.Exec(`
+			DELETE FROM online_users
+			WHERE instance_id NOT IN (SELECT id FROM instances)
+		`); err != nil {
+			return fmt.Errorf("could not delete online users of expired instances: %w", err)
+		}
+
+		return nil
+	}
+
+	if err := heartbeat(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(presenceHeartbeatInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := heartbeat(); err != nil {
+				log.Printf("could not send presence heartbeat: %v\n", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// stopPresence removes this instance from the shared presence.
+func stopPresence() {
+	if _, err := db.Exec(`DELETE FROM online_users WHERE instance_id = $1`, instanceID); err != nil {
+		log.Printf("could not delete online users of instance: %v\n", err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM instances WHERE id = $1`, instanceID); err != nil {
+		log.Printf("could not delete instance: %v\n", err)
+	}
+}
+
+// syncPresence records whether the user is connected to this instance.
+func syncPresence(uid string) error {
+	presenceSyncMu.Lock()
+	defer presenceSyncMu.Unlock()
+
+	if isOnlineHere(uid) {
+		if _, err := db.Exec(`
+			INSERT INTO online_users (user_id, instance_id) VALUES ($1, $2)
+			ON CONFLICT (user_id, instance_id) DO NOTHING
+		`, uid, instanceID); err != nil {
+			return fmt.Errorf("could not insert online user: %w", err)
+		}
+		return nil
+	}
+
+	if _, err := db.Exec(`
+		DELETE FROM online_users WHERE user_id = $1 AND instance_id = $2
+	`, uid, instanceID); err != nil {
+		return fmt.Errorf("could not delete online user: %w", err)
+	}
+	return nil
+}
+
+func userCameOnline(uid string) error {
+	if sharedPresence {
+		if err := syncPresence(uid); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	contactIDs, err := queryContactIDs(ctx, db, uid)
+	if err != nil {
+		return fmt.Errorf("could not query contact ids: %w", err)
+	}
+
+	go broadcast(Event{Name: EventUserPresence, Data: PresenceChange{
+		UserID:   uid,
+		Presence: Presence{Online: true},
+	}, ReceiverIDs: contactIDs})
+
+	return nil
+}
+
+func userWentOffline(uid string) error {
+	if sharedPresence {
+		if err := syncPresence(uid); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+
+	var lastSeenAt time.Time
+	var hideLastSeen bool
+	if err := db.QueryRowContext(ctx, `
+		UPDATE users SET last_seen_at = now()
+		WHERE id = $1
+		RETURNING last_seen_at, hide_last_seen
+	`, uid).Scan(&lastSeenAt, &hideLastSeen); err != nil {
+		return fmt.Errorf("could not update last seen at: %w", err)
+	}
+
+	// Reconnected in the meantime, or still connected to another instance.
+	if isOnline(uid) {
+		return nil
+	}
+
+	typingStoppedEverywhere(uid)
+
+	contactIDs, err := queryContactIDs(ctx, db, uid)
+	if err != nil {
+		return fmt.Errorf("could not query contact ids: %w", err)
+	}
+
+	go broadcast(Event{Name: EventUserPresence, Data: PresenceChange{
+		UserID:   uid,
+		Presence: *presenceOf(false, &lastSeenAt, hideLastSeen),
+	}, ReceiverIDs: contactIDs})
+
+	return nil
+}
+
+func lastSeenVisibilityChanged(uid string, lastSeenAt *time.Time, hideLastSeen bool) error {
+	contactIDs, err := queryContactIDs(context.Background(), db, uid)
+	if err != nil {
+		return fmt.Errorf("could not query contact ids: %w", err)
+	}
+
+	go broadcast(Event{Name: EventUserPresence, Data: PresenceChange{
+		UserID:   uid,
+		Presence: *presenceOf(isOnline(uid), lastSeenAt, hideLastSeen),
+	}, ReceiverIDs: contactIDs})
+
+	return nil
+}
+
+// queryContactIDs returns the IDs of the users
+// that share at least one conversation with the given user.
+func queryContactIDs(ctx context.Context, querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}, uid string) ([]string, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	rows, err := querier.QueryContext(ctx, `
+		SELECT DISTINCT others.user_id
+		FROM participants
+		INNER JOIN participants others
+			ON others.conversation_id = participants.conversation_id
+				AND others.user_id != participants.user_id
+		WHERE participants.user_id = $1
+	`, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var uids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		uids = append(uids, id)
+	}
+
+	return uids, rows.Err()
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// maxNotifyPayloadSize is the PostgreSQL limit on NOTIFY payloads.
+	maxNotifyPayloadSize = 8000
+	// largeEventLifetime is how long larger events are kept
+	// for the listeners to load them.
+	largeEventLifetime = time.Minute
+)
+
+// PubSub fans out realtime events to every server instance.
+type PubSub interface {
+	// Publish gives the event its ID, greater than the ones published before,
+	// so every instance knows it by the same ID.
+	Publish(ctx context.Context, e Event) error
+	// Subscribe calls fn with each event published by any instance
+	// until the context is canceled.
+	Subscribe(ctx context.Context, fn func(Event)) error
+}
+
+// MemoryPubSub only reaches the current instance.
+type MemoryPubSub struct {
+	mu          sync.RWMutex
+	subs        map[int]func(Event)
+	nextID      int
+	lastEventID uint64
+}
+
+// Publish the event to the subscribers of this same process.
+// Event IDs start from the boot time so they keep increasing across restarts
+// and clients from a previous run are asked to resync.
+func (ps *MemoryPubSub) Publish(_ context.Context, e Event) error {
+	// Locked all along so subscribers get the events in ID order.
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.lastEventID == 0 {
+		ps.lastEventID = uint64(time.Now().UnixNano())
+	}
+	ps.lastEventID++
+	e.ID = ps.lastEventID
+
+	for _, fn := range ps.subs {
+		fn(e)
+	}
+	return nil
+}
+
+// Subscribe to the events published on this same process.
+func (ps *MemoryPubSub) Subscribe(ctx context.Context, fn func(Event)) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.subs == nil {
+		ps.subs = make(map[int]func(Event))
+	}
+
+	id := ps.nextID
+	ps.nextID++
+	ps.subs[id] = fn
+
+	go func() {
+		<-ctx.Done()
+		ps.mu.Lock()
+		delete(ps.subs, id)
+		ps.mu.Unlock()
+	}()
+
+	return nil
+}
+
+// PostgresPubSub uses PostgreSQL LISTEN/NOTIFY
+// so instances behind a load balancer share events.
+// Event IDs come from the pubsub_channels table.
+// Events too large to notify are saved in the pubsub_events table
+// and only their ID is notified.
+// Events published while a listener reconnects are lost for it.
+type PostgresPubSub struct {
+	// DB used to notify.
+	DB *sql.DB
+	// ConnString used to open the dedicated listening connection.
+	ConnString string
+	Channel    string
+}
+
+// pubsubRef is notified in place of events too large.
+type pubsubRef struct {
+	Ref int64 `json:"ref"`
+}
+
+// pubsubEvent is the wire format of an event.
+type pubsubEvent struct {
+	ID          uint64          `json:"id"`
+	Name        string          `json:"name"`
+	Data        json.RawMessage `json:"data"`
+	ReceiverIDs []string        `json:"receiverIds"`
+}
+
+// Publish the event through NOTIFY.
+func (ps PostgresPubSub) Publish(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return fmt.Errorf("could not marshal event data: %w", err)
+	}
+
+	tx, err := ps.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin tx: %w", err)
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	// The channel row stays locked until commit
+	// and notifications go out in commit order,
+	// so every instance gets the events in ID order.
+	if err = tx.QueryRowContext(ctx, `
+		INSERT INTO pubsub_channels (name, last_event_id) VALUES ($1, 1)
+		ON CONFLICT (name) DO UPDATE SET last_event_id = pubsub_channels.last_event_id + 1
+		RETURNING last_event_id
+	`, ps.Channel).Scan(&e.ID); err != nil {
+		return fmt.Errorf("could not get next event id: %w", err)
+	}
+
+	payload, err := json.Marshal(pubsubEvent{
+		ID:          e.ID,
+		Name:        e.Name,
+		Data:        data,
+		ReceiverIDs: e.ReceiverIDs,
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal event: %w", err)
+	}
+
+	if len(payload) >= maxNotifyPayloadSize {
+		var ref pubsubRef
+		if err = tx.QueryRowContext(ctx, `
+			INSERT INTO pubsub_events (payload) VALUES ($1)
+			RETURNING id
+		`, string(payload)).Scan(&ref.Ref); err != nil {
+			return fmt.Errorf("could not insert large event: %w", err)
+		}
+
+		if payload, err = json.Marshal(ref); err != nil {
+			return fmt.Errorf("could not marshal event ref: %w", err)
+		}
+
+		go func() {
+			if _, err := ps.DB.Exec(`
+				DELETE FROM pubsub_events WHERE created_at < now() - $1 * INTERVAL '1 second'
+			`, int(largeEventLifetime.Seconds())); err != nil {
+				log.Printf("failed to do delete old pubsub events afterwork: %v\n", err)
+			}
+		}()
+	}
+
+	if _, err = tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, ps.Channel, string(payload)); err != nil {
+		return fmt.Errorf("could not notify event: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit tx to publish event: %w", err)
+	}
+
+	return nil
+}
+
+// Subscribe starts listening in the background.
+// The connection is reopened whenever it fails.
+func (ps PostgresPubSub) Subscribe(ctx context.Context, fn func(Event)) error {
+	go func() {
+		backoff := time.Second
+		for {
+			err := ps.listen(ctx, fn, func() { backoff = time.Second })
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Printf("pubsub listen failed, retrying in %s: %v\n", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		}
+	}()
+	return nil
+}
+
+func (ps PostgresPubSub) listen(ctx context.Context, fn func(Event), listening func()) error {
+	conn, err := pgx.Connect(ctx, ps.ConnString)
+	if err != nil {
+		return fmt.Errorf("could not connect: %w", err)
+	}
+
+	defer conn.Close(context.Background())
+
+	if _, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{ps.Channel}.Sanitize()); err != nil {
+		return fmt.Errorf("could not listen: %w", err)
+	}
+
+	listening()
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("could not wait for notification: %w", err)
+		}
+
+		payload, err := ps.load(ctx, []byte(n.Payload))
+		if err != nil {
+			log.Printf("could not load pubsub event: %v\n", err)
+			continue
+		}
+
+		e, err := decodePubSubEvent(payload)
+		if err != nil {
+			log.Printf("could not decode pubsub event: %v\n", err)
+			continue
+		}
+
+		fn(e)
+	}
+}
+
+// load returns the saved event if the payload is a reference to one.
+func (ps PostgresPubSub) load(ctx context.Context, payload []byte) ([]byte, error) {
+	var ref pubsubRef
+	if err := json.Unmarshal(payload, &ref); err != nil || ref.Ref == 0 {
+		return payload, nil
+	}
+
+	var saved string
+	if err := ps.DB.QueryRowContext(ctx, `
+		SELECT payload FROM pubsub_events WHERE id = $1
+	`, ref.Ref).Scan(&saved); err != nil {
+		return nil, fmt.Errorf("could not query large event %d: %w", ref.Ref, err)
+	}
+
+	return []byte(saved), nil
+}
+
+// decodePubSubEvent turns the wire format back into an event.
+// New messages, revoked sessions and typing stops get decoded into their types
+// since the realtime transports rely on them.
+func decodePubSubEvent(b []byte) (Event, error) {
+	var pe pubsubEvent
+	if err := json.Unmarshal(b, &pe); err != nil {
+		return Event{}, err
+	}
+
+	e := Event{ID: pe.ID, Name: pe.Name, Data: pe.Data, ReceiverIDs: pe.ReceiverIDs}
+	if pe.Name == EventMessageCreated {
+		var m Message
+		if err := json.Unmarshal(pe.Data, &m); err != nil {
+			return e, fmt.Errorf("could not unmarshal message: %w", err)
+		}
+
+		if m.User != nil {
+			m.UserID = m.User.ID
+		}
+		e.Data = m
+	} else if pe.Name == EventSessionsRevoked {
+		var revoked SessionsRevoked
+		if err := json.Unmarshal(pe.Data, &revoked); err != nil {
+			return e, fmt.Errorf("could not unmarshal revoked sessions: %w", err)
+		}
+
+		e.Data = revoked
+	} else if pe.Name == eventTypingStop {
+		var stop typingStop
+		if err := json.Unmarshal(pe.Data, &stop); err != nil {
+			return e, fmt.Errorf("could not unmarshal typing stop: %w", err)
+		}
+
+		e.Data = stop
+	}
+
+	return e, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/matryer/way"
+)
+
+const maxEmojiLength = 16
+
+// Reaction summary of a message.
+type Reaction struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+// ReactionChange sent through the realtime stream
+// when someone adds or removes a reaction.
+// Added tells which one the user did.
+type ReactionChange struct {
+	ConversationID string `json:"conversationId"`
+	MessageID      string `json:"messageId"`
+	Emoji          string `json:"emoji"`
+	Count          int    `json:"count"`
+	Added          bool   `json:"added"`
+	User           User   `json:"user"`
+}
+
+// POST /api/conversations/{conversation_id}/messages/{message_id}/reactions
+func addReaction(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Emoji string `json:"emoji"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	toggleReaction(w, r, in.Emoji, true)
+}
+
+// DELETE /api/conversations/{conversation_id}/messages/{message_id}/reactions?emoji={emoji}
+func removeReaction(w http.ResponseWriter, r *http.Request) {
+	toggleReaction(w, r, r.URL.Query().Get("emoji"), false)
+}
+
+func toggleReaction(w http.ResponseWriter, r *http.Request, emoji string, add bool) {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" {
+		respond(w, Errors{map[string]string{
+			"emoji": "Emoji required",
+		}}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if !isEmoji(emoji) {
+		respond(w, Errors{map[string]string{
+			"emoji": "Invalid emoji",
+		}}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	cid := way.Param(ctx, "conversation_id")
+	mid := way.Param(ctx, "message_id")
+
+	if !isID(cid) || !isID(mid) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	isParticipant, err := queryParticipantExistance(ctx, tx, uid, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query participant existance: %w", err))
+		return
+	}
+
+	if !isParticipant {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	var messageExists bool
+	if err = tx.QueryRowContext(ctx, `SELECT EXISTS (
+		SELECT 1 FROM messages
+		WHERE id = $1 AND conversation_id = $2 AND deleted_at IS NULL
+	)`, mid, cid).Scan(&messageExists); err != nil {
+		respondError(w, fmt.Errorf("could not query message existance: %w", err))
+		return
+	}
+
+	if !messageExists {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	if add {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO reactions (user_id, message_id, emoji) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, message_id, emoji) DO NOTHING
+		`, uid, mid, emoji)
+	} else {
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM reactions
+			WHERE user_id = $1 AND message_id = $2 AND emoji = $3
+		`, uid, mid, emoji)
+	}
+	if err != nil {
+		respondError(w, fmt.Errorf("could not toggle reaction: %w", err))
+		return
+	}
+
+	rc := ReactionChange{
+		ConversationID: cid,
+		MessageID:      mid,
+		Emoji:          emoji,
+		Added:          add,
+	}
+	if err = tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM reactions WHERE message_id = $1 AND emoji = $2
+	`, mid, emoji).Scan(&rc.Count); err != nil {
+		respondError(w, fmt.Errorf("could not count reactions: %w", err))
+		return
+	}
+
+	if rc.User, err = queryUser(ctx, tx, uid); err != nil {
+		respondError(w, fmt.Errorf("could not query auth user: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to toggle reaction: %w", err))
+		return
+	}
+
+	go func() {
+		if err := reactionChanged(rc); err != nil {
+			log.Printf("failed to do reaction changed afterwork: %v\n", err)
+		}
+	}()
+
+	respond(w, Reaction{
+		Emoji:   rc.Emoji,
+		Count:   rc.Count,
+		Reacted: rc.Added,
+	}, http.StatusOK)
+}
+
+func reactionChanged(rc ReactionChange) error {
+	uids, err := queryParticipantIDs(context.Background(), db, rc.ConversationID)
+	if err != nil {
+		return err
+	}
+
+	// The user's other devices get it too.
+	go broadcast(Event{Name: EventMessageReaction, Data: rc, ReceiverIDs: uids})
+
+	return nil
+}
+
+// queryReactions returns the reactions of each of the given messages
+// keyed by message ID, along with whether the user reacted.
+func queryReactions(ctx context.Context, querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}, userID string, mids ...string) (map[string][]Reaction, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	out := make(map[string][]Reaction, len(mids))
+	if len(mids) == 0 {
+		return out, nil
+	}
+
+	rows, err := querier.QueryContext(ctx, `
+		SELECT
+			message_id,
+			emoji,
+			count(*),
+			bool_or(user_id = $1)
+		FROM reactions
+		WHERE message_id = ANY($2)
+		GROUP BY message_id, emoji
+		ORDER BY min(created_at)
+	`, userID, mids)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var mid string
+		var r Reaction
+		if err = rows.Scan(&mid, &r.Emoji, &r.Count, &r.Reacted); err != nil {
+			return nil, err
+		}
+
+		out[mid] = append(out[mid], r)
+	}
+
+	return out, rows.Err()
+}
+
+// emojiSymbols are the code points with the Extended_Pictographic property
+// plus the regional indicators used by flags.
+var emojiSymbols = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x00A9, Hi: 0x00A9, Stride: 1},
+		{Lo: 0x00AE, Hi: 0x00AE, Stride: 1},
+		{Lo: 0x203C, Hi: 0x203C, Stride: 1},
+		{Lo: 0x2049, Hi: 0x2049, Stride: 1},
+		{Lo: 0x2122, Hi: 0x2122, Stride: 1},
+		{Lo: 0x2139, Hi: 0x2139, Stride: 1},
+		{Lo: 0x2194, Hi: 0x2199, Stride: 1},
+		{Lo: 0x21A9, Hi: 0x21AA, Stride: 1},
+		{Lo: 0x231A, Hi: 0x231B, Stride: 1},
+		{Lo: 0x2328, Hi: 0x2328, Stride: 1},
+		{Lo: 0x2388, Hi: 0x2388, Stride: 1},
+		{Lo: 0x23CF, Hi: 0x23CF, Stride: 1},
+		{Lo: 0x23E9, Hi: 0x23F3, Stride: 1},
+		{Lo: 0x23F8, Hi: 0x23FA, Stride: 1},
+		{Lo: 0x24C2, Hi: 0x24C2, Stride: 1},
+		{Lo: 0x25AA, Hi: 0x25AB, Stride: 1},
+		{Lo: 0x25B6, Hi: 0x25B6, Stride: 1},
+		{Lo: 0x25C0, Hi: 0x25C0, Stride: 1},
+		{Lo: 0x25FB, Hi: 0x25FE, Stride: 1},
+		{Lo: 0x2600, Hi: 0x2605, Stride: 1},
+		{Lo: 0x2607, Hi: 0x2612, Stride: 1},
+		{Lo: 0x2614, Hi: 0x2685, Stride: 1},
+		{Lo: 0x2690, Hi: 0x2705, Stride: 1},
+		{Lo: 0x2708, Hi: 0x2712, Stride: 1},
+		{Lo: 0x2714, Hi: 0x2714, Stride: 1},
+		{Lo: 0x2716, Hi: 0x2716, Stride: 1},
+		{Lo: 0x271D, Hi: 0x271D, Stride: 1},
+		{Lo: 0x2721, Hi: 0x2721, Stride: 1},
+		{Lo: 0x2728, Hi: 0x2728, Stride: 1},
+		{Lo: 0x2733, Hi: 0x2734, Stride: 1},
+		{Lo: 0x2744, Hi: 0x2744, Stride: 1},
+		{Lo: 0x2747, Hi: 0x2747, Stride: 1},
+		{Lo: 0x274C, Hi: 0x274C, Stride: 1},
+		{Lo: 0x274E, Hi: 0x274E, Stride: 1},
+		{Lo: 0x2753, Hi: 0x2755, Stride: 1},
+		{Lo: 0x2757, Hi: 0x2757, Stride: 1},
+		{Lo: 0x2763, Hi: 0x2767, Stride: 1},
+		{Lo: 0x2795, Hi: 0x2797, Stride: 1},
+		{Lo: 0x27A1, Hi: 0x27A1, Stride: 1},
+		{Lo: 0x27B0, Hi: 0x27B0, Stride: 1},
+		{Lo: 0x27BF, Hi: 0x27BF, Stride: 1},
+		{Lo: 0x2934, Hi: 0x2935, Stride: 1},
+		{Lo: 0x2B05, Hi: 0x2B07, Stride: 1},
+		{Lo: 0x2B1B, Hi: 0x2B1C, Stride: 1},
+		{Lo: 0x2B50, Hi: 0x2B50, Stride: 1},
+		{Lo: 0x2B55, Hi: 0x2B55, Stride: 1},
+		{Lo: 0x3030, Hi: 0x3030, Stride: 1},
+		{Lo: 0x303D, Hi: 0x303D, Stride: 1},
+		{Lo: 0x3297, Hi: 0x3297, Stride: 1},
+		{Lo: 0x3299, Hi: 0x3299, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1F000, Hi: 0x1F0FF, Stride: 1},
+		{Lo: 0x1F10D, Hi: 0x1F10F, Stride: 1},
+		{Lo: 0x1F12F, Hi: 0x1F12F, Stride: 1},
+		{Lo: 0x1F16C, Hi: 0x1F171, Stride: 1},
+		{Lo: 0x1F17E, Hi: 0x1F17F, Stride: 1},
+		{Lo: 0x1F18E, Hi: 0x1F18E, Stride: 1},
+		{Lo: 0x1F191, Hi: 0x1F19A, Stride: 1},
+		{Lo: 0x1F1AD, Hi: 0x1F1FF, Stride: 1},
+		{Lo: 0x1F201, Hi: 0x1F20F, Stride: 1},
+		{Lo: 0x1F21A, Hi: 0x1F21A, Stride: 1},
+		{Lo: 0x1F22F, Hi: 0x1F22F, Stride: 1},
+		{Lo: 0x1F232, Hi: 0x1F23A, Stride: 1},
+		{Lo: 0x1F23C, Hi: 0x1F23F, Stride: 1},
+		{Lo: 0x1F249, Hi: 0x1F3FA, Stride: 1},
+		{Lo: 0x1F400, Hi: 0x1F53D, Stride: 1},
+		{Lo: 0x1F546, Hi: 0x1F64F, Stride: 1},
+		{Lo: 0x1F680, Hi: 0x1F6FF, Stride: 1},
+		{Lo: 0x1F774, Hi: 0x1F77F, Stride: 1},
+		{Lo: 0x1F7D5, Hi: 0x1F7FF, Stride: 1},
+		{Lo: 0x1F80C, Hi: 0x1F80F, Stride: 1},
+		{Lo: 0x1F848, Hi: 0x1F84F, Stride: 1},
+		{Lo: 0x1F85A, Hi: 0x1F85F, Stride: 1},
+		{Lo: 0x1F888, Hi: 0x1F88F, Stride: 1},
+		{Lo: 0x1F8AE, Hi: 0x1F8FF, Stride: 1},
+		{Lo: 0x1F90C, Hi: 0x1F93A, Stride: 1},
+		{Lo: 0x1F93C, Hi: 0x1F945, Stride: 1},
+		{Lo: 0x1F947, Hi: 0x1FAFF, Stride: 1},
+		{Lo: 0x1FC00, Hi: 0x1FFFD, Stride: 1},
+	},
+	LatinOffset: 2,
+}
+
+// isEmoji reports whether s looks like a single emoji sequence:
+// symbols joined by zero width joiners, variation selectors,
+// skin tone modifiers, keycaps and tags.
+func isEmoji(s string) bool {
+	runes := []rune(s)
+	if len(runes) == 0 || len(runes) > maxEmojiLength {
+		return false
+	}
+
+	hasSymbol := false
+	for _, r := range runes {
+		switch {
+		case r >= 0x1F3FB && r <= 0x1F3FF: // skin tone modifiers.
+		case unicode.Is(emojiSymbols, r):
+			hasSymbol = true
+		case r == 0x200D, // zero width joiner.
+			r == 0xFE0F,                  // variation selector-16.
+			r == 0x20E3,                  // combining enclosing keycap.
+			r >= 0xE0020 && r <= 0xE007F, // tags.
+			r == '#', r == '*', r >= '0' && r <= '9':
+		default:
+			return false
+		}
+	}
+	return hasSymbol || strings.ContainsRune(s, 0x20E3)
+}
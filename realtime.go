@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sseHeartbeatInterval keeps idle streams from being closed by proxies.
+	sseHeartbeatInterval = time.Second * 15
+	// sseRetry is how long clients wait before reconnecting.
+	sseRetry = time.Second * 3
+	// sseMaxLifetime after which streams get closed
+	// so clients reconnect, possibly to another instance.
+	sseMaxLifetime = time.Minute * 30
+)
+
+// Realtime event types.
+const (
+	EventMessageCreated       = "message.created"
+	EventMessageUpdated       = "message.updated"
+	EventMessageDeleted       = "message.deleted"
+	EventMessageReaction      = "message.reaction"
+	EventMessageReceipt       = "message.receipt"
+	EventAttachmentProcessed  = "attachment.processed"
+	EventConversationCreated  = "conversation.created"
+	EventConversationUpdated  = "conversation.updated"
+	EventParticipantRead      = "participant.read"
+	EventParticipantTyping    = "participant.typing"
+	EventUserPresence         = "user.presence"
+	EventSessionsRevoked      = "sessions.revoked"
+	EventStreamResyncRequired = "stream.resync_required"
+)
+
+// EventEnvelope is how events are written to the realtime streams.
+type EventEnvelope struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// Event sent through the realtime stream.
+// Name is one of the event types above.
+// ID is assigned on broadcast.
+type Event struct {
+	ID          uint64
+	Name        string
+	Data        interface{}
+	ReceiverIDs []string
+}
+
+// GET /api/messages
+func subscribeToMessages(w http.ResponseWriter, r *http.Request) {
+	if a := r.Header.Get("Accept"); !strings.Contains(a, "text/event-stream") {
+		http.Error(w, "This endpoint requires an EventSource connection", http.StatusNotAcceptable)
+		return
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		respondError(w, errors.New("streaming unsupported"))
+		return
+	}
+
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("Content-Type", "text/event-stream")
+
+	client := registerMessageClient(uid, ctx.Value(keyAuthSessionID).(string))
+	defer unregisterMessageClient(client)
+
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+
+	// Replay what the client missed since it got disconnected.
+	// Registered before so nothing broadcasted in between is lost;
+	// replayed events that also come through the channel are skipped.
+	var replayed map[uint64]struct{}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		// Sent by clients that had to open a new connection,
+		// like after renewing an expired token.
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		missed, ok := events.since(id, uid)
+		if err != nil || !ok {
+			writeEvent(w, Event{Name: EventStreamResyncRequired, Data: struct{}{}})
+		} else {
+			replayed = make(map[uint64]struct{}, len(missed))
+			for _, e := range missed {
+				writeEvent(w, e)
+				replayed[e.ID] = struct{}{}
+			}
+		}
+	}
+	f.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	// Jittered so streams opened together don't reconnect together.
+	lifetime := time.NewTimer(sseMaxLifetime - time.Duration(rand.Int63n(int64(sseMaxLifetime/10))))
+	defer lifetime.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-client.Closed():
+			return
+		case <-lifetime.C:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			f.Flush()
+		case e := <-client.Events:
+			if _, ok := replayed[e.ID]; ok {
+				continue
+			}
+
+			writeEvent(w, e)
+			f.Flush()
+
+			eventSent(e, uid)
+		}
+	}
+}
+
+// writeEvent writes the event in server-sent events format.
+func writeEvent(w http.ResponseWriter, e Event) {
+	if e.ID != 0 {
+		fmt.Fprintf(w, "id: %d\n", e.ID)
+	}
+
+	if b, err := json.Marshal(EventEnvelope{Type: e.Name, Data: e.Data}); err != nil {
+		log.Printf("could not marshall event data: %v\n", err)
+		fmt.Fprintf(w, "event: error\ndata: %v\n\n", err)
+	} else {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Name, b)
+	}
+}
+
+// registerMessageClient adds a client to the hub.
+// Shared by all the realtime transports.
+func registerMessageClient(uid, sid string) *MessageClient {
+	client := hub.register(uid, sid)
+	if userConnected(uid) {
+		go func() {
+			if err := userCameOnline(uid); err != nil {
+				log.Printf("failed to do user came online afterwork: %v\n", err)
+			}
+		}()
+	}
+	return client
+}
+
+func unregisterMessageClient(client *MessageClient) {
+	hub.unregister(client)
+	if userDisconnected(client.UserID) {
+		go func() {
+			if err := userWentOffline(client.UserID); err != nil {
+				log.Printf("failed to do user went offline afterwork: %v\n", err)
+			}
+		}()
+	}
+}
+
+// eventSent runs after an event got written to a client of the user.
+func eventSent(e Event, uid string) {
+	if m, ok := e.Data.(Message); ok && e.Name == EventMessageCreated {
+		go func() {
+			if err := messageDelivered(m, uid); err != nil {
+				log.Printf("failed to do message delivered afterwork: %v\n", err)
+			}
+		}()
+	}
+}
+
+// broadcast publishes the event to every server instance.
+func broadcast(e Event) {
+	if err := pubsub.Publish(context.Background(), e); err != nil {
+		log.Printf("could not publish event: %v\n", err)
+	}
+}
+
+// deliverMu keeps events reaching the log and the clients
+// in the same order.
+var deliverMu sync.Mutex
+
+// deliver sends an event published by any instance
+// to the matching clients connected to this one.
+func deliver(e Event) {
+	if stop, ok := e.Data.(typingStop); ok && e.Name == eventTypingStop {
+		clearTyping(stop)
+		return
+	}
+
+	deliverMu.Lock()
+	events.append(e)
+	hub.deliver(e)
+	deliverMu.Unlock()
+
+	if revoked, ok := e.Data.(SessionsRevoked); ok && e.Name == EventSessionsRevoked {
+		hub.closeSessions(e.ReceiverIDs, revoked.IDs)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Message statuses as seen by their author.
+const (
+	MessageStatusSent      = "sent"
+	MessageStatusDelivered = "delivered"
+	MessageStatusRead      = "read"
+)
+
+// MessageReceipt sent through the realtime stream to the authors
+// of the messages that got delivered to or read by a participant.
+type MessageReceipt struct {
+	ConversationID string `json:"conversationId"`
+	UserID         string `json:"userId"`
+	// Statuses keyed by message ID.
+	Statuses map[string]string `json:"statuses"`
+}
+
+// messageDelivered records that the message reached
+// one of the realtime streams of the user and lets the author know.
+func messageDelivered(m Message, uid string) error {
+	if m.System || m.UserID == uid {
+		return nil
+	}
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin tx: %w", err)
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	var inserted bool
+	if err = tx.QueryRowContext(ctx, `
+		INSERT INTO message_deliveries (user_id, message_id) VALUES ($1, $2)
+		ON CONFLICT (user_id, message_id) DO NOTHING
+		RETURNING true
+	`, uid, m.ID).Scan(&inserted); err == sql.ErrNoRows {
+		// Already delivered to another stream of the same user.
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not insert message delivery: %w", err)
+	}
+
+	statuses, err := queryMessageStatuses(ctx, tx, m.ID)
+	if err != nil {
+		return fmt.Errorf("could not query message status: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit tx to deliver message: %w", err)
+	}
+
+	go broadcast(Event{Name: EventMessageReceipt, Data: MessageReceipt{
+		ConversationID: m.ConversationID,
+		UserID:         uid,
+		Statuses:       statuses,
+	}, ReceiverIDs: []string{m.UserID}})
+
+	return nil
+}
+
+// messagesRead lets the authors of the messages the user just read know.
+// Only messages created in between the previous and current read times are considered.
+func messagesRead(ctx context.Context, tx *sql.Tx, uid, cid string, prevReadAt, readAt time.Time) ([]Event, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, user_id FROM messages
+		WHERE conversation_id = $1
+			AND user_id != $2
+			AND system = false
+			AND deleted_at IS NULL
+			AND created_at > $3
+			AND created_at <= $4
+	`, cid, uid, prevReadAt, readAt)
+	if err != nil {
+		return nil, fmt.Errorf("could not query read messages: %w", err)
+	}
+
+	defer rows.Close()
+
+	var mids []string
+	authors := make(map[string]string)
+	for rows.Next() {
+		var mid, authorID string
+		if err = rows.Scan(&mid, &authorID); err != nil {
+			return nil, fmt.Errorf("could not scan read message: %w", err)
+		}
+
+		mids = append(mids, mid)
+		authors[mid] = authorID
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not iterate over read messages: %w", err)
+	}
+
+	statuses, err := queryMessageStatuses(ctx, tx, mids...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query message statuses: %w", err)
+	}
+
+	byAuthor := make(map[string]map[string]string)
+	for mid, authorID := range authors {
+		if _, ok := byAuthor[authorID]; !ok {
+			byAuthor[authorID] = make(map[string]string)
+		}
+		byAuthor[authorID][mid] = statuses[mid]
+	}
+
+	ee := make([]Event, 0, len(byAuthor))
+	for authorID, statuses := range byAuthor {
+		ee = append(ee, Event{Name: EventMessageReceipt, Data: MessageReceipt{
+			ConversationID: cid,
+			UserID:         uid,
+			Statuses:       statuses,
+		}, ReceiverIDs: []string{authorID}})
+	}
+
+	return ee, nil
+}
+
+// queryMessageStatuses returns the status of each of the given messages keyed by message ID.
+// A message is delivered or read once it is so for every other participant.
+// Participants whose read time is past the message creation count as both.
+func queryMessageStatuses(ctx context.Context, querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}, mids ...string) (map[string]string, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	out := make(map[string]string, len(mids))
+	if len(mids) == 0 {
+		return out, nil
+	}
+
+	for _, mid := range mids {
+		out[mid] = MessageStatusSent
+	}
+
+	rows, err := querier.QueryContext(ctx, `
+		SELECT
+			messages.id,
+			count(*),
+			count(CASE WHEN participants.messages_read_at >= messages.created_at
+				OR message_deliveries.user_id IS NOT NULL THEN 1 END),
+			count(CASE WHEN participants.messages_read_at >= messages.created_at THEN 1 END)
+		FROM messages
+		INNER JOIN participants ON participants.conversation_id = messages.conversation_id
+			AND participants.user_id != messages.user_id
+		LEFT JOIN message_deliveries ON message_deliveries.message_id = messages.id
+			AND message_deliveries.user_id = participants.user_id
+		WHERE messages.id = ANY($1)
+		GROUP BY messages.id
+	`, mids)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var mid string
+		var recipients, delivered, read int
+		if err = rows.Scan(&mid, &recipients, &delivered, &read); err != nil {
+			return nil, fmt.Errorf("could not scan message status: %w", err)
+		}
+
+		switch {
+		case read == recipients:
+			out[mid] = MessageStatusRead
+		case delivered == recipients:
+			out[mid] = MessageStatusDelivered
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not iterate over message statuses: %w", err)
+	}
+
+	return out, nil
+}
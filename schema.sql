@@ -6,12 +6,69 @@ CREATE TABLE IF NOT EXISTS users (
     id SERIAL NOT NULL PRIMARY KEY,
     username STRING NOT NULL UNIQUE,
     avatar_url STRING,
-    github_id INT UNIQUE
+    last_seen_at TIMESTAMPTZ,
+    hide_last_seen BOOL NOT NULL DEFAULT false,
+    totp_secret BYTES,
+    totp_enabled BOOL NOT NULL DEFAULT false,
+    totp_last_step INT NOT NULL DEFAULT 0,
+    totp_failed_attempts INT NOT NULL DEFAULT 0,
+    totp_locked_until TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id INT NOT NULL REFERENCES users ON DELETE CASCADE,
+    code_hash BYTES NOT NULL,
+    used_at TIMESTAMPTZ,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider STRING NOT NULL,
+    provider_user_id STRING NOT NULL,
+    user_id INT NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (provider, provider_user_id),
+    INDEX (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS used_magic_links (
+    id STRING NOT NULL PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS magic_link_requests (
+    id SERIAL NOT NULL PRIMARY KEY,
+    email STRING NOT NULL,
+    ip STRING NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX (email, created_at),
+    INDEX (ip, created_at)
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users ON DELETE CASCADE,
+    user_agent STRING NOT NULL DEFAULT '',
+    ip STRING NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ,
+    INDEX (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash BYTES NOT NULL PRIMARY KEY,
+    session_id INT NOT NULL REFERENCES sessions ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    INDEX (session_id)
 );
 
 CREATE TABLE IF NOT EXISTS conversations (
     id SERIAL NOT NULL PRIMARY KEY,
     last_message_id INT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
     INDEX (last_message_id)
 );
 
@@ -19,7 +76,10 @@ CREATE TABLE IF NOT EXISTS participants (
     user_id INT NOT NULL REFERENCES users ON DELETE CASCADE,
     conversation_id INT NOT NULL REFERENCES conversations ON DELETE CASCADE,
     messages_read_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-    PRIMARY KEY (user_id, conversation_id)
+    unread_messages_count INT NOT NULL DEFAULT 0,
+    is_admin BOOL NOT NULL DEFAULT false,
+    PRIMARY KEY (user_id, conversation_id),
+    INDEX (conversation_id)
 );
 
 CREATE TABLE IF NOT EXISTS messages (
@@ -27,8 +87,95 @@ CREATE TABLE IF NOT EXISTS messages (
     content STRING(480) NOT NULL,
     user_id INT NOT NULL REFERENCES users ON DELETE CASCADE,
     conversation_id INT NOT NULL REFERENCES conversations ON DELETE CASCADE,
+    system BOOL NOT NULL DEFAULT false,
+    reply_to_id INT REFERENCES messages ON DELETE SET NULL,
     created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-    INDEX (created_at DESC)
+    edited_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ,
+    INDEX (created_at DESC),
+    INDEX (reply_to_id)
+);
+
+CREATE TABLE IF NOT EXISTS message_deliveries (
+    user_id INT NOT NULL REFERENCES users ON DELETE CASCADE,
+    message_id INT NOT NULL REFERENCES messages ON DELETE CASCADE,
+    delivered_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, message_id),
+    INDEX (message_id)
+);
+
+CREATE TABLE IF NOT EXISTS reactions (
+    user_id INT NOT NULL REFERENCES users ON DELETE CASCADE,
+    message_id INT NOT NULL REFERENCES messages ON DELETE CASCADE,
+    emoji STRING(64) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, message_id, emoji),
+    INDEX (message_id)
+);
+
+CREATE TABLE IF NOT EXISTS attachments (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users ON DELETE CASCADE,
+    conversation_id INT NOT NULL REFERENCES conversations ON DELETE CASCADE,
+    message_id INT REFERENCES messages ON DELETE CASCADE,
+    blob_key STRING NOT NULL UNIQUE,
+    filename STRING NOT NULL,
+    content_type STRING NOT NULL,
+    size INT NOT NULL,
+    width INT,
+    height INT,
+    processed_at TIMESTAMPTZ,
+    processing_failed BOOL NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX (message_id)
+);
+
+CREATE TABLE IF NOT EXISTS attachment_thumbnails (
+    attachment_id INT NOT NULL REFERENCES attachments ON DELETE CASCADE,
+    size INT NOT NULL,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    content_type STRING NOT NULL,
+    blob_key STRING NOT NULL UNIQUE,
+    PRIMARY KEY (attachment_id, size)
+);
+
+CREATE TABLE IF NOT EXISTS hidden_messages (
+    user_id INT NOT NULL REFERENCES users ON DELETE CASCADE,
+    message_id INT NOT NULL REFERENCES messages ON DELETE CASCADE,
+    PRIMARY KEY (user_id, message_id)
+);
+
+CREATE TABLE IF NOT EXISTS message_revisions (
+    id SERIAL NOT NULL PRIMARY KEY,
+    message_id INT NOT NULL REFERENCES messages ON DELETE CASCADE,
+    content STRING(480) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    INDEX (message_id, created_at DESC)
+);
+
+CREATE TABLE IF NOT EXISTS instances (
+    id STRING NOT NULL PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS online_users (
+    user_id INT NOT NULL REFERENCES users ON DELETE CASCADE,
+    instance_id STRING NOT NULL,
+    PRIMARY KEY (user_id, instance_id),
+    INDEX (instance_id)
+);
+
+-- These two live in the PUBSUB_URL database when it is a separate PostgreSQL server.
+CREATE TABLE IF NOT EXISTS pubsub_channels (
+    name TEXT NOT NULL PRIMARY KEY,
+    last_event_id BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS pubsub_events (
+    id BIGSERIAL NOT NULL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
 ALTER TABLE conversations ADD CONSTRAINT fk_last_message_id_ref_messages
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	searchPageSize     = 20
+	searchBatchSize    = 100
+	maxSearchScanned   = 1000
+	searchSnippetRunes = 120
+	maxSearchTerms     = 10
+)
+
+// SearchResult of a message matching a search query.
+type SearchResult struct {
+	Message           Message     `json:"message"`
+	ConversationID    string      `json:"conversationId"`
+	Snippet           string      `json:"snippet"`
+	Highlights        []Highlight `json:"highlights"`
+	PreviousMessageID *string     `json:"previousMessageId"`
+	NextMessageID     *string     `json:"nextMessageId"`
+}
+
+// Highlight is a range of runes of a snippet matching the search query.
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// SearchResults page.
+type SearchResults struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor *string        `json:"nextCursor"`
+}
+
+// searchTerm is either a single word, a word prefix or a phrase of words.
+type searchTerm struct {
+	words  []string
+	prefix bool
+}
+
+// GET /api/messages/search?q={q}&cursor={cursor}
+//
+// Words match whole words, words ending in * match as prefix,
+// and "quoted words" match as a phrase. All of them must match.
+// It uses plain pattern matching so it works the same
+// on CockroachDB and PostgreSQL.
+func searchMessages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	terms := parseSearchQuery(q.Get("q"))
+	if len(terms) == 0 {
+		respond(w, Errors{map[string]string{
+			"q": "Search query required",
+		}}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if len(terms) > maxSearchTerms {
+		respond(w, Errors{map[string]string{
+			"q": fmt.Sprintf("Too many search terms. %d max", maxSearchTerms),
+		}}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	cursor := strings.TrimSpace(q.Get("cursor"))
+	if cursor != "" && !isID(cursor) {
+		respond(w, Errors{map[string]string{
+			"cursor": "Invalid cursor",
+		}}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	out := SearchResults{Results: make([]SearchResult, 0, searchPageSize)}
+	scanned := 0
+	exhausted := false
+	for !exhausted && len(out.Results) < searchPageSize && scanned < maxSearchScanned {
+		candidates, err := querySearchCandidates(ctx, tx, uid, terms, cursor)
+		if err != nil {
+			respondError(w, fmt.Errorf("could not query search candidates: %w", err))
+			return
+		}
+
+		exhausted = len(candidates) < searchBatchSize
+		for i, m := range candidates {
+			scanned++
+			cursor = m.ID
+
+			spans := matchSearchTerms(m.Content, terms)
+			if spans == nil {
+				continue
+			}
+
+			snippet, highlights := makeSnippet(m.Content, spans)
+			out.Results = append(out.Results, SearchResult{
+				Message:        m,
+				ConversationID: m.ConversationID,
+				Snippet:        snippet,
+				Highlights:     highlights,
+			})
+
+			if len(out.Results) == searchPageSize {
+				exhausted = exhausted && i == len(candidates)-1
+				break
+			}
+		}
+	}
+
+	if exhausted {
+		cursor = ""
+	}
+
+	if cursor != "" {
+		out.NextCursor = &cursor
+	}
+
+	for i, res := range out.Results {
+		if err = tx.QueryRowContext(ctx, `
+			SELECT
+				(SELECT id FROM messages
+					WHERE conversation_id = $1 AND id < $2 AND deleted_at IS NULL
+					ORDER BY id DESC
+					LIMIT 1),
+				(SELECT id FROM messages
+					WHERE conversation_id = $1 AND id > $2 AND deleted_at IS NULL
+					ORDER BY id
+					LIMIT 1)
+		`, res.ConversationID, res.Message.ID).Scan(
+			&out.Results[i].PreviousMessageID,
+			&out.Results[i].NextMessageID,
+		); err != nil {
+			respondError(w, fmt.Errorf("could not query surrounding messages: %w", err))
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to search messages: %w", err))
+		return
+	}
+
+	respond(w, out, http.StatusOK)
+}
+
+// querySearchCandidates returns messages from the user conversations
+// containing all the terms as substrings.
+// They still have to be checked against word boundaries.
+func querySearchCandidates(ctx context.Context, tx *sql.Tx, uid string, terms []searchTerm, before string) ([]Message, error) {
+	query := `
+		SELECT
+			messages.id,
+			messages.content,
+			messages.conversation_id,
+			messages.created_at,
+			messages.edited_at,
+			messages.user_id = $1 AS mine,
+			users.id,
+			users.username,
+			users.avatar_url
+		FROM messages
+		INNER JOIN participants
+			ON participants.conversation_id = messages.conversation_id
+				AND participants.user_id = $1
+		INNER JOIN users ON messages.user_id = users.id
+		WHERE messages.deleted_at IS NULL
+			AND messages.system = false
+			AND NOT EXISTS (
+				SELECT 1 FROM hidden_messages
+				WHERE hidden_messages.user_id = $1
+					AND hidden_messages.message_id = messages.id
+			)`
+	args := []interface{}{uid}
+
+	for _, t := range terms {
+		for _, word := range t.words {
+			args = append(args, "%"+escapeLike(word)+"%")
+			query += fmt.Sprintf(" AND messages.content ILIKE $%d", len(args))
+		}
+	}
+
+	if before != "" {
+		args = append(args, before)
+		query += fmt.Sprintf(" AND messages.id < $%d", len(args))
+	}
+
+	query += fmt.Sprintf(`
+		ORDER BY messages.id DESC
+		LIMIT %d`, searchBatchSize)
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	mm := make([]Message, 0, searchBatchSize)
+	for rows.Next() {
+		var m Message
+		var u User
+		if err = rows.Scan(
+			&m.ID,
+			&m.Content,
+			&m.ConversationID,
+			&m.CreatedAt,
+			&m.EditedAt,
+			&m.Mine,
+			&u.ID,
+			&u.Username,
+			&u.AvatarURL,
+		); err != nil {
+			return nil, err
+		}
+
+		m.User = &u
+		mm = append(mm, m)
+	}
+
+	return mm, rows.Err()
+}
+
+func parseSearchQuery(q string) []searchTerm {
+	var terms []searchTerm
+	for i, part := range strings.Split(q, `"`) {
+		// Odd parts are inside quotes.
+		if i%2 == 1 {
+			if words := searchWords(part); len(words) != 0 {
+				terms = append(terms, searchTerm{words: words})
+			}
+			continue
+		}
+
+		for _, field := range strings.Fields(part) {
+			prefix := strings.HasSuffix(field, "*")
+			for _, word := range searchWords(field) {
+				terms = append(terms, searchTerm{words: []string{word}, prefix: prefix})
+			}
+		}
+	}
+	return terms
+}
+
+// searchWords splits s into lowercased words made of letters and digits.
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+type wordSpan struct {
+	word       string
+	start, end int
+}
+
+// matchSearchTerms returns the rune ranges of content matching the terms,
+// or nil if any of them does not match.
+func matchSearchTerms(content string, terms []searchTerm) []Highlight {
+	var words []wordSpan
+	start := -1
+	runes := []rune(content)
+	for i := 0; i <= len(runes); i++ {
+		isWordRune := i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]))
+		if isWordRune && start == -1 {
+			start = i
+		} else if !isWordRune && start != -1 {
+			words = append(words, wordSpan{
+				word:  strings.ToLower(string(runes[start:i])),
+				start: start,
+				end:   i,
+			})
+			start = -1
+		}
+	}
+
+	var highlights []Highlight
+	for _, t := range terms {
+		matched := false
+		for i := 0; i+len(t.words) <= len(words); i++ {
+			if !matchWords(words[i:i+len(t.words)], t) {
+				continue
+			}
+
+			matched = true
+			highlights = append(highlights, Highlight{
+				Start: words[i].start,
+				End:   words[i+len(t.words)-1].end,
+			})
+		}
+
+		if !matched {
+			return nil
+		}
+	}
+
+	// Sort and merge overlapping ranges.
+	sort.Slice(highlights, func(i, j int) bool {
+		return highlights[i].Start < highlights[j].Start
+	})
+	merged := highlights[:1]
+	for _, h := range highlights[1:] {
+		last := &merged[len(merged)-1]
+		if h.Start <= last.End {
+			if h.End > last.End {
+				last.End = h.End
+			}
+			continue
+		}
+		merged = append(merged, h)
+	}
+	return merged
+}
+
+func matchWords(words []wordSpan, t searchTerm) bool {
+	for i, w := range t.words {
+		last := i == len(t.words)-1
+		if t.prefix && last {
+			if !strings.HasPrefix(words[i].word, w) {
+				return false
+			}
+		} else if words[i].word != w {
+			return false
+		}
+	}
+	return true
+}
+
+// makeSnippet cuts content around the first highlight
+// and shifts the highlights to the snippet.
+func makeSnippet(content string, highlights []Highlight) (string, []Highlight) {
+	runes := []rune(content)
+	from := len(runes)
+	for _, h := range highlights {
+		if h.Start < from {
+			from = h.Start
+		}
+	}
+
+	from -= searchSnippetRunes / 4
+	if from < 0 {
+		from = 0
+	}
+	to := from + searchSnippetRunes
+	if to > len(runes) {
+		to = len(runes)
+	}
+
+	var b strings.Builder
+	offset := -from
+	if from > 0 {
+		b.WriteString("…")
+		offset++
+	}
+	b.WriteString(string(runes[from:to]))
+	if to < len(runes) {
+		b.WriteString("…")
+	}
+
+	out := make([]Highlight, 0, len(highlights))
+	for _, h := range highlights {
+		if h.Start < from || h.End > to {
+			continue
+		}
+		out = append(out, Highlight{Start: h.Start + offset, End: h.End + offset})
+	}
+
+	return b.String(), out
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matryer/way"
+)
+
+const (
+	// accessTokenLifetime is kept short
+	// since access tokens are stateless and can't be revoked.
+	accessTokenLifetime = time.Minute * 15
+	// refreshTokenLifetime is how long a session can stay idle.
+	// Each refresh hands out a new refresh token with a new lifetime.
+	refreshTokenLifetime = time.Hour * 24 * 14 // 14 days.
+)
+
+// Session of a user on some device.
+// Each login starts a new one.
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	Current    bool      `json:"current"`
+}
+
+// SessionsRevoked sent through the realtime stream
+// so the revoked sessions get their streams closed.
+type SessionsRevoked struct {
+	IDs []string `json:"ids"`
+}
+
+// AuthTokens handed out when logging in and on each refresh.
+type AuthTokens struct {
+	Token                 string    `json:"token"`
+	ExpiresAt             time.Time `json:"expiresAt"`
+	RefreshToken          string    `json:"refreshToken"`
+	RefreshTokenExpiresAt time.Time `json:"refreshTokenExpiresAt"`
+}
+
+// POST /api/refresh_token
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if in.RefreshToken == "" {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	hash := hashRefreshToken(in.RefreshToken)
+
+	var uid, sid string
+	var expiresAt time.Time
+	var usedAt, revokedAt *time.Time
+	if err = tx.QueryRowContext(ctx, `
+		SELECT sessions.user_id, sessions.id, refresh_tokens.expires_at, refresh_tokens.used_at, sessions.revoked_at
+		FROM refresh_tokens
+		INNER JOIN sessions ON sessions.id = refresh_tokens.session_id
+		WHERE refresh_tokens.token_hash = $1
+		FOR UPDATE
+	`, hash).Scan(&uid, &sid, &expiresAt, &usedAt, &revokedAt); err == sql.ErrNoRows {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query refresh token: %w", err))
+		return
+	}
+
+	if revokedAt != nil || !expiresAt.After(time.Now()) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	// A rotated refresh token coming back means it got copied somewhere.
+	// There is no telling which side is the legit one, so the whole session goes.
+	if usedAt != nil {
+		if err = tx.Rollback(); err != nil {
+			respondError(w, fmt.Errorf("could not rollback tx: %w", err))
+			return
+		}
+
+		if _, err = revokeSessions(ctx, uid, sid); err != nil {
+			respondError(w, fmt.Errorf("could not revoke session: %w", err))
+			return
+		}
+
+		log.Printf("refresh token reused; session %s of user %s revoked\n", sid, uid)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		UPDATE refresh_tokens SET used_at = now() WHERE token_hash = $1
+	`, hash); err != nil {
+		respondError(w, fmt.Errorf("could not mark refresh token as used: %w", err))
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		UPDATE sessions SET last_used_at = now(), user_agent = $1, ip = $2
+		WHERE id = $3
+	`, r.UserAgent(), clientIP(r), sid); err != nil {
+		respondError(w, fmt.Errorf("could not update session: %w", err))
+		return
+	}
+
+	tokens, err := issueAuthTokens(ctx, tx, uid, sid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not issue auth tokens: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to refresh token: %w", err))
+		return
+	}
+
+	respond(w, tokens, http.StatusOK)
+}
+
+// GET /api/sessions
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	sid := ctx.Value(keyAuthSessionID).(string)
+
+	// Sessions not refreshed within the refresh token lifetime are gone already.
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, user_agent, ip, created_at, last_used_at
+		FROM sessions
+		WHERE user_id = $1
+			AND revoked_at IS NULL
+			AND last_used_at > $2
+		ORDER BY last_used_at DESC
+	`, uid, time.Now().Add(-refreshTokenLifetime))
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query sessions: %w", err))
+		return
+	}
+
+	defer rows.Close()
+
+	ss := make([]Session, 0)
+	for rows.Next() {
+		var s Session
+		if err = rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt); err != nil {
+			respondError(w, fmt.Errorf("could not scan session: %w", err))
+			return
+		}
+
+		s.Device = deviceName(s.UserAgent)
+		s.Current = s.ID == sid
+		ss = append(ss, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over sessions: %w", err))
+		return
+	}
+
+	respond(w, ss, http.StatusOK)
+}
+
+// DELETE /api/sessions/{session_id}
+func revokeSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	sid := way.Param(ctx, "session_id")
+
+	if !isID(sid) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	revoked, err := revokeSessions(ctx, uid, sid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not revoke session: %w", err))
+		return
+	}
+
+	if len(revoked) == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /api/sessions
+// Logs out everywhere, the current session included.
+func revokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+
+	if _, err := revokeSessions(ctx, uid); err != nil {
+		respondError(w, fmt.Errorf("could not revoke sessions: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/logout
+func logout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	sid := ctx.Value(keyAuthSessionID).(string)
+
+	if _, err := revokeSessions(ctx, uid, sid); err != nil {
+		respondError(w, fmt.Errorf("could not revoke session: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respondWithSession starts a new session for the user
+// and responds with its tokens along with the user.
+// Users with two-factor authentication get a token
+// to finish logging in with a code instead.
+func respondWithSession(w http.ResponseWriter, r *http.Request, user User) {
+	ctx := r.Context()
+
+	challenge, err := twoFactorChallenge(ctx, user.ID)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	if challenge != "" {
+		respond(w, map[string]interface{}{
+			"twoFactorRequired": true,
+			"twoFactorToken":    challenge,
+		}, http.StatusOK)
+		return
+	}
+
+	tokens, err := startSession(ctx, user.ID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		respondError(w, fmt.Errorf("could not start session: %w", err))
+		return
+	}
+
+	respondWithTokens(w, user, tokens)
+}
+
+func respondWithTokens(w http.ResponseWriter, user User, tokens AuthTokens) {
+	respond(w, map[string]interface{}{
+		"authUser":              user,
+		"token":                 tokens.Token,
+		"expiresAt":             tokens.ExpiresAt,
+		"refreshToken":          tokens.RefreshToken,
+		"refreshTokenExpiresAt": tokens.RefreshTokenExpiresAt,
+	}, http.StatusOK)
+}
+
+// startSession creates a new session for the user
+// along with its first access and refresh tokens.
+func startSession(ctx context.Context, uid, userAgent, ip string) (AuthTokens, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return AuthTokens{}, fmt.Errorf("could not begin tx: %w", err)
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	var sid string
+	if err = tx.QueryRowContext(ctx, `
+		INSERT INTO sessions (user_id, user_agent, ip) VALUES ($1, $2, $3)
+		RETURNING id
+	`, uid, userAgent, ip).Scan(&sid); err != nil {
+		return AuthTokens{}, fmt.Errorf("could not insert session: %w", err)
+	}
+
+	tokens, err := issueAuthTokens(ctx, tx, uid, sid)
+	if err != nil {
+		return AuthTokens{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return AuthTokens{}, fmt.Errorf("could not commit tx to start session: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// revokeSessions revokes the given sessions of the user, or all of them if none given,
+// and closes their realtime streams.
+// It returns the IDs of the sessions that were still active.
+func revokeSessions(ctx context.Context, uid string, sids ...string) ([]string, error) {
+	query := `UPDATE sessions SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL`
+	args := []interface{}{uid}
+	if len(sids) != 0 {
+		query += ` AND id = ANY($2)`
+		args = append(args, sids)
+	}
+	query += ` RETURNING id`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var revoked []string
+	for rows.Next() {
+		var sid string
+		if err = rows.Scan(&sid); err != nil {
+			return nil, fmt.Errorf("could not scan revoked session id: %w", err)
+		}
+
+		revoked = append(revoked, sid)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not iterate over revoked sessions: %w", err)
+	}
+
+	if len(revoked) != 0 {
+		go broadcast(Event{Name: EventSessionsRevoked, Data: SessionsRevoked{
+			IDs: revoked,
+		}, ReceiverIDs: []string{uid}})
+	}
+
+	return revoked, nil
+}
+
+// querySessionActive tells whether the session of the user was not revoked.
+func querySessionActive(ctx context.Context, uid, sid string) (bool, error) {
+	var active bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (
+		SELECT 1 FROM sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	)`, sid, uid).Scan(&active)
+	return active, err
+}
+
+// issueAuthTokens creates a new refresh token for the session
+// and an access token tied to it.
+func issueAuthTokens(ctx context.Context, tx *sql.Tx, uid, sid string) (AuthTokens, error) {
+	refreshToken, err := generateRefreshToken()
+	if err != nil {
+		return AuthTokens{}, fmt.Errorf("could not generate refresh token: %w", err)
+	}
+
+	now := time.Now()
+	tokens := AuthTokens{
+		ExpiresAt:             now.Add(accessTokenLifetime),
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: now.Add(refreshTokenLifetime),
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, session_id, expires_at) VALUES ($1, $2, $3)
+	`, hashRefreshToken(refreshToken), sid, tokens.RefreshTokenExpiresAt); err != nil {
+		return AuthTokens{}, fmt.Errorf("could not insert refresh token: %w", err)
+	}
+
+	if tokens.Token, err = issueToken(uid, sid, tokens.ExpiresAt); err != nil {
+		return AuthTokens{}, fmt.Errorf("could not issue access token: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// generateRefreshToken returns an opaque random token.
+func generateRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// deviceName gives a short description of the user agent
+// like "Firefox on Linux".
+func deviceName(userAgent string) string {
+	var browser, os string
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		os = "Android"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		os = "iOS"
+	case strings.Contains(userAgent, "Windows"):
+		os = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		os = "Linux"
+	}
+
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	}
+	return "Unknown device"
+}
+
+// hashRefreshToken so the stored ones are useless if leaked.
+// A fast hash is fine since the tokens are random and long.
+func hashRefreshToken(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
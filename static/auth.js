@@ -18,9 +18,39 @@ export function getAuthUser() {
     }
 }
 
+/**
+ * Authenticated while either the access token is valid
+ * or it can still be refreshed.
+ */
 export function isAuthenticated() {
-    const token = localStorage.getItem('token')
-    const expiresAtItem = localStorage.getItem('expires_at')
+    return isValid('token', 'expires_at') || isValid('refresh_token', 'refresh_token_expires_at')
+}
+
+/**
+ * @param {AuthTokens} tokens
+ */
+export function saveTokens(tokens) {
+    localStorage.setItem('token', tokens.token)
+    localStorage.setItem('expires_at', tokens.expiresAt)
+    localStorage.setItem('refresh_token', tokens.refreshToken)
+    localStorage.setItem('refresh_token_expires_at', tokens.refreshTokenExpiresAt)
+}
+
+export function clearAuth() {
+    localStorage.removeItem('auth_user')
+    localStorage.removeItem('token')
+    localStorage.removeItem('expires_at')
+    localStorage.removeItem('refresh_token')
+    localStorage.removeItem('refresh_token_expires_at')
+}
+
+/**
+ * @param {string} tokenKey
+ * @param {string} expiresAtKey
+ */
+function isValid(tokenKey, expiresAtKey) {
+    const token = localStorage.getItem(tokenKey)
+    const expiresAtItem = localStorage.getItem(expiresAtKey)
     if (token === null || expiresAtItem === null) {
         return false
     }
@@ -43,6 +73,14 @@ export function guard(fn1, fn2) {
         : fn2(...args)
 }
 
+/**
+ * @typedef AuthTokens
+ * @property {string} token
+ * @property {string} expiresAt
+ * @property {string} refreshToken
+ * @property {string} refreshTokenExpiresAt
+ */
+
 /**
  * @typedef AuthUser
  * @property {string} id
@@ -1,4 +1,10 @@
-import { isAuthenticated } from './auth.js';
+import { clearAuth, isAuthenticated, saveTokens } from './auth.js';
+
+// refreshMargin is how long before it expires the access token gets refreshed.
+const refreshMargin = 30 * 1000
+
+/** @type {Promise<string>=} */
+let refreshing = null
 
 /**
  * @param {Response} res
@@ -7,9 +13,7 @@ async function handleResponse(res) {
     const body = await res.clone().json().catch(() => res.text())
 
     if (res.status === 401) {
-        localStorage.removeItem('auth_user')
-        localStorage.removeItem('token')
-        localStorage.removeItem('expires_at')
+        clearAuth()
     }
 
     if (!res.ok) {
@@ -30,9 +34,49 @@ async function handleResponse(res) {
     return body
 }
 
-function getAuthHeader() {
+/**
+ * Returns a valid access token, refreshing it if it's about to expire.
+ * Using the same refresh token twice revokes the whole session,
+ * so only one refresh runs at a time, even across tabs.
+ * @param {boolean=} force refreshes even if the token didn't expire,
+ * like to find out whether the session is still active.
+ * @returns {Promise<string>}
+ */
+function freshToken(force = false) {
+    const token = localStorage.getItem('token')
+    if (!force && !needsRefresh()) {
+        return Promise.resolve(token)
+    }
+
+    if (refreshing === null) {
+        const refresh = () => needsRefresh() || (force && localStorage.getItem('refresh_token') !== null && localStorage.getItem('token') === token)
+            ? fetch('/api/refresh_token', {
+                method: 'POST',
+                headers: { 'content-type': 'application/json; charset=utf-8' },
+                body: JSON.stringify({ refreshToken: localStorage.getItem('refresh_token') }),
+            }).then(handleResponse).then(tokens => {
+                saveTokens(tokens)
+                return tokens.token
+            })
+            // Another tab refreshed it already.
+            : localStorage.getItem('token')
+        refreshing = Promise.resolve('locks' in navigator ? navigator.locks.request('refresh_token', refresh) : refresh())
+            .finally(() => {
+                refreshing = null
+            })
+    }
+    return refreshing
+}
+
+function needsRefresh() {
+    const expiresAt = new Date(localStorage.getItem('expires_at'))
+    return localStorage.getItem('refresh_token') !== null
+        && (isNaN(expiresAt.valueOf()) || expiresAt.valueOf() - Date.now() < refreshMargin)
+}
+
+async function getAuthHeader() {
     return isAuthenticated()
-        ? { authorization: `Bearer ${localStorage.getItem('token')}` }
+        ? { authorization: `Bearer ${await freshToken()}` }
         : {}
 }
 
@@ -41,9 +85,9 @@ export default {
      * @param {string} url
      * @param {{[x: string]: string}=} headers
      */
-    get(url, headers) {
+    async get(url, headers) {
         return fetch(url, {
-            headers: Object.assign(getAuthHeader(), headers),
+            headers: Object.assign(await getAuthHeader(), headers),
         }).then(handleResponse)
     },
 
@@ -52,12 +96,14 @@ export default {
      * @param {(FormData|File|{[x: string]: string})=} body
      * @param {{[x: string]: string}=} headers
      */
-    post(url, body, headers) {
+    async post(url, body, headers) {
         const init = {
             method: 'POST',
-            headers: getAuthHeader(),
+            headers: await getAuthHeader(),
         }
-        if (typeof body === 'object' && body !== null) {
+        if (body instanceof FormData || body instanceof Blob) {
+            init.body = body
+        } else if (typeof body === 'object' && body !== null) {
             init.body = JSON.stringify(body)
             init.headers['content-type'] = 'application/json; charset=utf-8'
         }
@@ -67,26 +113,111 @@ export default {
 
     /**
      * @param {string} url
-     * @param {function} callback
+     * @param {{[x: string]: string}=} body
+     * @param {{[x: string]: string}=} headers
      */
-    subscribe(url, callback) {
-        const urlWithToken = new URL(url, location.origin)
-        if (isAuthenticated()) {
-            urlWithToken.searchParams.set('token', localStorage.getItem('token'))
+    async patch(url, body, headers) {
+        const init = {
+            method: 'PATCH',
+            headers: await getAuthHeader(),
+        }
+        if (typeof body === 'object' && body !== null) {
+            init.body = JSON.stringify(body)
+            init.headers['content-type'] = 'application/json; charset=utf-8'
         }
-        const eventSource = new EventSource(urlWithToken.toString())
-        eventSource.onmessage = ev => {
-            let data
+        Object.assign(init.headers, headers)
+        return fetch(url, init).then(handleResponse)
+    },
+
+    /**
+     * @param {string} url
+     * @param {{[x: string]: string}=} headers
+     */
+    async delete(url, headers) {
+        return fetch(url, {
+            method: 'DELETE',
+            headers: Object.assign(await getAuthHeader(), headers),
+        }).then(handleResponse)
+    },
+
+    /**
+     * Returns a valid access token for the places where headers can't be set,
+     * like links and redirects.
+     * @returns {Promise<string=>}
+     */
+    token() {
+        return isAuthenticated() ? freshToken() : Promise.resolve(null)
+    },
+
+    /**
+     * @param {string} url
+     * @param {{[eventType: string]: function}=} listeners called with the event data.
+     */
+    subscribe(url, listeners = {}) {
+        /** @type {EventSource=} */
+        let eventSource = null
+        let lastEventId = ''
+        let closed = false
+        const handle = fn => ev => {
+            if (ev.lastEventId) {
+                lastEventId = ev.lastEventId
+            }
+            let envelope
             try {
-                data = JSON.parse(ev.data)
+                envelope = JSON.parse(ev.data)
             } catch (err) {
-                console.error('could not parse message data as JSON:', err)
+                console.error('could not parse event data as JSON:', err)
                 return
             }
-            callback(data)
+            fn(envelope.data)
         }
+        /**
+         * @param {boolean=} reconnecting
+         */
+        const connect = async (reconnecting = false) => {
+            const urlWithToken = new URL(url, location.origin)
+            if (isAuthenticated()) {
+                urlWithToken.searchParams.set('token', await freshToken(reconnecting))
+            }
+            if (lastEventId !== '') {
+                urlWithToken.searchParams.set('last_event_id', lastEventId)
+            }
+            if (closed) {
+                return
+            }
+            eventSource = new EventSource(urlWithToken.toString())
+            for (const [eventName, listener] of Object.entries(listeners)) {
+                eventSource.addEventListener(eventName, handle(listener))
+            }
+            // Too many events were missed while reconnecting.
+            if (!('stream.resync_required' in listeners)) {
+                eventSource.addEventListener('stream.resync_required', () => {
+                    location.reload()
+                })
+            }
+            // The browser gives up reconnecting by itself
+            // when the token in the URL expired or its session got revoked.
+            eventSource.addEventListener('error', () => {
+                if (eventSource.readyState === EventSource.CLOSED && !closed && isAuthenticated()) {
+                    setTimeout(() => {
+                        connect(true).catch(err => {
+                            console.error('could not reconnect:', err)
+                            if (!isAuthenticated()) {
+                                location.reload()
+                            }
+                        })
+                    }, 3000)
+                }
+            })
+        }
+        connect().catch(err => {
+            console.error('could not connect:', err)
+        })
         const unsubscribe = () => {
-            eventSource.close()
+            closed = true
+            if (eventSource !== null) {
+                eventSource.close()
+            }
         }
         return unsubscribe
     },
@@ -6,6 +6,8 @@ const viewAccess = location.hostname === 'localhost' ? view('dev-access') : view
 const r = createRouter()
 r.route('/', guard(view('home'), viewAccess))
 r.route('/callback', view('callback'))
+r.route('/magic-link', view('magic-link'))
+r.route('/two-factor', view('two-factor'))
 r.route(/^\/conversations\/([^\/]+)$/, guard(view('conversation'), viewAccess))
 r.route(/^\//, view('not-found'))
 r.subscribe(render)
@@ -1,11 +1,80 @@
-const template = document.createElement('template')
-template.innerHTML = `
-    <div class="container">
-        <h1>Messenger</h1>
-        <a href="/api/oauth/github" onclick="event.stopPropagation()">Access with GitHub</a>
-    </div>
-`
-
-export default function accessPage() {
-    return template.content
+import http from '../http.js';
+import { escapeHTML } from '../shared.js';
+
+export default async function accessPage() {
+    const providers = await getOAuthProviders().catch(err => {
+        console.error(err)
+        return []
+    })
+
+    const template = document.createElement('template')
+    template.innerHTML = `
+        <div class="container">
+            <h1>Messenger</h1>
+            <ul class="oauth-providers">
+                ${providers.map(renderOAuthProvider).join('')}
+            </ul>
+        </div>
+    `
+    const page = template.content
+    page.querySelector('.container').appendChild(magicLinkForm())
+    return page
+}
+
+/**
+ * @returns {Promise<{name:string,title:string}[]>}
+ */
+export function getOAuthProviders() {
+    return http.get('/api/oauth_providers')
+}
+
+export function renderOAuthProvider(provider) {
+    return `<li><a href="/api/oauth/${encodeURIComponent(provider.name)}" onclick="event.stopPropagation()">Access with ${escapeHTML(provider.title)}</a></li>`
+}
+
+/**
+ * Form to get a login link by email.
+ */
+export function magicLinkForm() {
+    const form = document.createElement('form')
+    form.className = 'magic-link-form'
+    form.innerHTML = `
+        <input type="email" placeholder="Email" required>
+        <button>Email me a login link</button>
+    `
+    const input = form.querySelector('input')
+    const button = form.querySelector('button')
+
+    input.addEventListener('input', () => {
+        input.setCustomValidity('')
+    })
+
+    form.addEventListener('submit', async ev => {
+        ev.preventDefault()
+        input.disabled = true
+        button.disabled = true
+        try {
+            await sendMagicLink(input.value)
+            form.innerHTML = `<p>Check your inbox at ${escapeHTML(input.value)} for a login link.</p>`
+        } catch (err) {
+            if (err.statusCode === 422) {
+                input.setCustomValidity(err.body.errors.email)
+                input.reportValidity()
+            } else {
+                alert(err.message)
+            }
+        } finally {
+            input.disabled = false
+            button.disabled = false
+        }
+    })
+
+    return form
+}
+
+/**
+ * @param {string} email
+ */
+function sendMagicLink(email) {
+    return http.post('/api/magic_links', { email })
 }
@@ -1,24 +1,29 @@
 import { navigate } from 'https://unpkg.com/@nicolasparada/router@0.8.0/router.js';
+import { saveTokens } from '../auth.js';
 import http from '../http.js';
 
 export default async function callbackPage() {
-    const url = new URL(location.toString())
-    let token = url.searchParams.get('token')
-    let expiresAt = url.searchParams.get('expires_at')
+    // Tokens come in the fragment so they never reach the server.
+    const params = new URLSearchParams(location.hash.substr(1))
+    let token = params.get('token')
+    let expiresAt = params.get('expires_at')
+    let refreshToken = params.get('refresh_token')
+    let refreshTokenExpiresAt = params.get('refresh_token_expires_at')
 
     try {
-        if (token === null || expiresAt === null) {
+        if (token === null || expiresAt === null || refreshToken === null || refreshTokenExpiresAt === null) {
             throw new Error('Invalid URL')
         }
 
         token = decodeURIComponent(token)
         expiresAt = decodeURIComponent(expiresAt)
+        refreshToken = decodeURIComponent(refreshToken)
+        refreshTokenExpiresAt = decodeURIComponent(refreshTokenExpiresAt)
 
         const authUser = await getAuthUser(token)
 
         localStorage.setItem('auth_user', JSON.stringify(authUser))
-        localStorage.setItem('token', token)
-        localStorage.setItem('expires_at', expiresAt)
+        saveTokens({ token, expiresAt, refreshToken, refreshTokenExpiresAt })
     } catch (err) {
         alert(err.message)
     } finally {
@@ -1,7 +1,12 @@
 import { navigate } from 'https://unpkg.com/@nicolasparada/router@0.8.0/router.js';
+import { getAuthUser } from '../auth.js';
 import http from '../http.js';
 import { ago, avatar, escapeHTML, flashTitle, linkify, loadEventSourcePolyfill } from '../shared.js';
 
+// typingInterval is how often, at most, the typing signal is sent
+// while the user keeps typing.
+const typingInterval = 3000
+
 // ConversationPage is a custom element
 // so it takes advantage of disconnectedCallback
 // to unsubscribe from the messages.
@@ -15,9 +20,27 @@ class ConversationPage extends HTMLElement {
         this.conversationId = conversationId
 
         this.onBackLinkClick = this.onBackLinkClick.bind(this)
+        this.onLeaveClick = this.onLeaveClick.bind(this)
         this.onLoadMoreClick = this.onLoadMoreClick.bind(this)
+        this.onLoadNewerClick = this.onLoadNewerClick.bind(this)
         this.onMessageSubmit = this.onMessageSubmit.bind(this)
         this.onMessageArrive = this.onMessageArrive.bind(this)
+        this.onMessageUpdate = this.onMessageUpdate.bind(this)
+        this.onMessagesDblClick = this.onMessagesDblClick.bind(this)
+        this.onMessageDelete = this.onMessageDelete.bind(this)
+        this.onMessagesContextMenu = this.onMessagesContextMenu.bind(this)
+        this.onMessagesClick = this.onMessagesClick.bind(this)
+        this.onReaction = this.onReaction.bind(this)
+        this.onAttachmentProcessed = this.onAttachmentProcessed.bind(this)
+        this.onMessageInput = this.onMessageInput.bind(this)
+        this.onTyping = this.onTyping.bind(this)
+        this.onReceipt = this.onReceipt.bind(this)
+        this.onPresence = this.onPresence.bind(this)
+
+        this.participants = []
+        /** @type {Map<string, {username: string, timeout: number}>} */
+        this.typingUsers = new Map()
+        this.lastTypingSentAt = 0
     }
 
     /**
@@ -28,27 +51,65 @@ class ConversationPage extends HTMLElement {
         history.back()
     }
 
+    async onLeaveClick() {
+        if (!confirm('Leave this conversation?')) {
+            return
+        }
+
+        this.leaveButton.disabled = true
+        try {
+            await leaveConversation(this.conversationId)
+            navigate('/', true)
+        } catch (err) {
+            alert(err.message)
+            this.leaveButton.disabled = false
+        }
+    }
+
     async onLoadMoreClick() {
         const before = this.loadMoreButton.dataset['before']
 
         this.loadMoreButton.disabled = true
-        const messages = await getMessages(this.conversationId, before).catch(err => {
+        const page = await getMessages(this.conversationId, { before }).catch(err => {
             console.error(err)
-            return []
+            return { messages: [], hasMoreBefore: false }
         })
         this.loadMoreButton.disabled = false
 
         const firstLI = this.loadMoreButton.parentElement
-        for (const m of messages) {
+        for (const m of page.messages) {
             firstLI.insertAdjacentElement('afterend', renderMessage(m))
         }
 
-        if (messages.length !== 25) {
-            this.loadMoreButton.remove()
+        if (!page.hasMoreBefore) {
+            firstLI.remove()
+            return
+        }
+
+        this.loadMoreButton.dataset['before'] = page.messages[page.messages.length - 1].id
+    }
+
+    async onLoadNewerClick() {
+        const after = this.loadNewerButton.dataset['after']
+
+        this.loadNewerButton.disabled = true
+        const page = await getMessages(this.conversationId, { after }).catch(err => {
+            console.error(err)
+            return { messages: [], hasMoreAfter: false }
+        })
+        this.loadNewerButton.disabled = false
+
+        const lastLI = this.loadNewerButton.parentElement
+        for (const m of page.messages.reverse()) {
+            lastLI.insertAdjacentElement('beforebegin', renderMessage(m))
+        }
+
+        if (!page.hasMoreAfter) {
+            lastLI.remove()
             return
         }
 
-        this.loadMoreButton.dataset['before'] = messages[24].i
+        this.loadNewerButton.dataset['after'] = page.messages[page.messages.length - 1].id
     }
 
     /**
@@ -61,8 +122,16 @@ class ConversationPage extends HTMLElement {
         this.messageSubmitButton.disabled = true
 
         try {
-            const m = await createMessage(this.messageInput.value, this.conversationId)
+            const attachmentIds = []
+            for (const file of Array.from(this.fileInput.files)) {
+                const attachment = await uploadAttachment(this.conversationId, file)
+                attachmentIds.push(attachment.id)
+            }
+            const m = await createMessage(this.messageInput.value, this.conversationId, this.replyToId, attachmentIds)
             this.messageInput.value = ''
+            this.fileInput.value = ''
+            this.lastTypingSentAt = 0
+            this.cancelReply()
             const messagesOList = document.getElementById('messages')
             if (messagesOList !== null) {
                 messagesOList.appendChild(renderMessage(m))
@@ -86,12 +155,24 @@ class ConversationPage extends HTMLElement {
     }
 
     onMessageArrive(message) {
-        flashTitle(message.content.substr(0, 20) + '...')
+        normalizeMessage(message)
+        if (!message.mine) {
+            flashTitle(message.content.substr(0, 20) + '...')
+        }
 
         if (message.conversationId !== this.conversationId) {
             return
         }
 
+        // Sent from this same device.
+        if (this.messagesOList.querySelector(`.message[data-id="${message.id}"]`) !== null) {
+            return
+        }
+
+        if (message.user) {
+            this.removeTypingUser(message.user.id)
+        }
+
         this.messagesOList.appendChild(renderMessage(message))
         const isAtTheBottom = this.messagesOList.scrollTop + this.messagesOList.clientHeight === this.messagesOList.scrollHeight
         if (isAtTheBottom) {
@@ -102,23 +183,284 @@ class ConversationPage extends HTMLElement {
         readMessages(message.conversationId)
     }
 
+    onMessageUpdate(message) {
+        if (message.conversationId !== this.conversationId) {
+            return
+        }
+
+        normalizeMessage(message)
+
+        const li = this.messagesOList.querySelector(`.message[data-id="${message.id}"]`)
+        if (li !== null) {
+            li.replaceWith(renderMessage(message))
+        }
+    }
+
+    /**
+     * @param {MouseEvent} ev
+     */
+    async onMessagesDblClick(ev) {
+        const li = /** @type {HTMLElement} */ (ev.target).closest('.message.owned')
+        if (li === null) {
+            return
+        }
+
+        const content = prompt('Edit message', li.querySelector('.buble p').textContent)
+        if (content === null) {
+            return
+        }
+
+        try {
+            const m = await updateMessage(this.conversationId, li.dataset['id'], content)
+            li.replaceWith(renderMessage(m))
+        } catch (err) {
+            alert(err.statusCode === 422 ? err.body.errors.content : err.message)
+        }
+    }
+
+    onMessageDelete(message) {
+        if (message.conversationId !== this.conversationId) {
+            return
+        }
+
+        const li = this.messagesOList.querySelector(`.message[data-id="${message.id}"]`)
+        if (li !== null) {
+            li.remove()
+        }
+    }
+
+    /**
+     * @param {MouseEvent} ev
+     */
+    async onMessagesContextMenu(ev) {
+        const li = /** @type {HTMLElement} */ (ev.target).closest('.message:not(.system)')
+        if (li === null) {
+            return
+        }
+
+        ev.preventDefault()
+
+        let forWhom
+        if (li.classList.contains('owned') && confirm('Delete for everyone?')) {
+            forWhom = 'everyone'
+        } else if (confirm('Delete for me?')) {
+            forWhom = 'me'
+        } else {
+            return
+        }
+
+        try {
+            await deleteMessage(this.conversationId, li.dataset['id'], forWhom)
+            li.remove()
+        } catch (err) {
+            alert(err.message)
+        }
+    }
+
+    /**
+     * @param {MouseEvent} ev
+     */
+    async onMessagesClick(ev) {
+        const target = /** @type {HTMLElement} */ (ev.target)
+        const replyButton = target.closest('.reply-button')
+        if (replyButton !== null) {
+            const li = replyButton.closest('.message')
+            this.replyToId = li.dataset['id']
+            this.replyingTo.hidden = false
+            this.replyingTo.querySelector('span').textContent = li.querySelector('.buble p').textContent
+            this.messageInput.focus()
+            return
+        }
+
+        if (target.closest('.cancel-reply-button') !== null) {
+            this.cancelReply()
+            return
+        }
+
+        const button = target.closest('.reaction, .add-reaction')
+        if (button === null) {
+            return
+        }
+
+        const li = button.closest('.message')
+        let emoji = button.dataset['emoji']
+        if (button.classList.contains('add-reaction')) {
+            emoji = prompt('React with emoji')
+            if (emoji === null || emoji.trim() === '') {
+                return
+            }
+        }
+
+        try {
+            const reacted = button.classList.contains('reacted')
+            const reaction = reacted
+                ? await removeReaction(this.conversationId, li.dataset['id'], emoji)
+                : await addReaction(this.conversationId, li.dataset['id'], emoji)
+            updateReaction(li, reaction, true)
+        } catch (err) {
+            alert(err.statusCode === 422 ? err.body.errors.emoji : err.message)
+        }
+    }
+
+    cancelReply() {
+        this.replyToId = undefined
+        this.replyingTo.hidden = true
+    }
+
+    onReaction(change) {
+        if (change.conversationId !== this.conversationId) {
+            return
+        }
+
+        const li = this.messagesOList.querySelector(`.message[data-id="${change.messageId}"]`)
+        if (li !== null) {
+            updateReaction(li, {
+                emoji: change.emoji,
+                count: change.count,
+                reacted: change.added,
+            }, change.user.id === getAuthUser().id)
+        }
+    }
+
+    onAttachmentProcessed({ conversationId, attachment }) {
+        if (conversationId !== this.conversationId) {
+            return
+        }
+
+        const el = this.messagesOList.querySelector(`.attachment[data-id="${attachment.id}"]`)
+        if (el !== null) {
+            el.outerHTML = renderAttachment(attachment)
+        }
+    }
+
+    onReceipt({ conversationId, statuses }) {
+        if (conversationId !== this.conversationId) {
+            return
+        }
+
+        for (const [messageId, status] of Object.entries(statuses)) {
+            const el = this.messagesOList.querySelector(`.message[data-id="${messageId}"] .status`)
+            if (el !== null) {
+                el.outerHTML = renderStatus(status)
+            }
+        }
+    }
+
+    onPresence({ userId, online, lastSeenAt }) {
+        const participant = this.participants.find(p => p.id === userId)
+        if (participant === undefined) {
+            return
+        }
+
+        participant.presence = { online, lastSeenAt }
+        this.renderPresence()
+    }
+
+    renderPresence() {
+        if (this.presenceEl === undefined) {
+            return
+        }
+
+        const authUser = getAuthUser()
+        const otherParticipants = this.participants.filter(p => p.id !== authUser.id)
+        this.presenceEl.textContent = otherParticipants.length === 1
+            ? presenceText(otherParticipants[0].presence)
+            : `${otherParticipants.filter(p => p.presence && p.presence.online).length} online`
+    }
+
+    onMessageInput() {
+        if (this.messageInput.value.trim() === '' || Date.now() - this.lastTypingSentAt < typingInterval) {
+            return
+        }
+
+        this.lastTypingSentAt = Date.now()
+        sendTyping(this.conversationId).catch(err => {
+            console.error(err)
+        })
+    }
+
+    onTyping({ conversationId, user, typing, expiresAt }) {
+        if (conversationId !== this.conversationId) {
+            return
+        }
+
+        if (!typing) {
+            this.removeTypingUser(user.id)
+            return
+        }
+
+        const prev = this.typingUsers.get(user.id)
+        if (prev !== undefined) {
+            clearTimeout(prev.timeout)
+        }
+
+        // The server sends a stop signal on expiry,
+        // this is just in case it never arrives.
+        const timeout = setTimeout(() => {
+            this.removeTypingUser(user.id)
+        }, Math.max(new Date(expiresAt).getTime() - Date.now(), 0) + 1000)
+
+        this.typingUsers.set(user.id, { username: user.username, timeout })
+        this.renderTypingIndicator()
+    }
+
+    /**
+     * @param {string} userId
+     */
+    removeTypingUser(userId) {
+        const entry = this.typingUsers.get(userId)
+        if (entry === undefined) {
+            return
+        }
+
+        clearTimeout(entry.timeout)
+        this.typingUsers.delete(userId)
+        this.renderTypingIndicator()
+    }
+
+    renderTypingIndicator() {
+        if (this.typingIndicator === undefined) {
+            return
+        }
+
+        const usernames = Array.from(this.typingUsers.values()).map(entry => entry.username)
+        this.typingIndicator.hidden = usernames.length === 0
+        this.typingIndicator.textContent = usernames.length === 1
+            ? `${usernames[0]} is typing…`
+            : `${usernames.join(', ')} are typing…`
+    }
+
     async connectedCallback() {
-        let otherParticipant, messages
+        const around = new URLSearchParams(location.search).get('message')
+        let participants, page
         try {
-            [otherParticipant, messages] = await Promise.all([
-                getOtherParticipantFromConversation(this.conversationId),
-                getMessages(this.conversationId),
+            [participants, page] = await Promise.all([
+                getParticipants(this.conversationId),
+                getMessages(this.conversationId, around !== null ? { around } : {}),
             ])
-            this.unsubscribeFromMessages = await subscribeToMessages(this.onMessageArrive)
+            this.unsubscribeFromMessages = await subscribeToMessages({
+                'message.created': this.onMessageArrive,
+                'message.updated': this.onMessageUpdate,
+                'message.deleted': this.onMessageDelete,
+                'message.reaction': this.onReaction,
+                'message.receipt': this.onReceipt,
+                'attachment.processed': this.onAttachmentProcessed,
+                'participant.typing': this.onTyping,
+                'user.presence': this.onPresence,
+            })
         } catch (err) {
             alert(err.message)
             navigate('/', true)
             return
         }
 
-        const messagesLength = messages.length
-        const showLoadMoreButton = messagesLength === 25
-        const lastMessage = messages[messagesLength - 1]
+        const messages = page.messages
+        const showLoadMoreButton = page.hasMoreBefore
+        const showLoadNewerButton = page.hasMoreAfter
+        const lastMessage = messages[messages.length - 1]
+        const firstMessage = messages[0]
+        const authUser = getAuthUser()
+        const otherParticipants = participants.filter(p => p.id !== authUser.id)
 
         const template = document.createElement('template')
         template.innerHTML = `
@@ -126,46 +468,91 @@ class ConversationPage extends HTMLElement {
                 <div class="chat-heading">
                     <a href="/" id="back-link" class="back-link">← Back</a>
                     <div class="avatar-wrapper">
-                        ${avatar(otherParticipant)}
-                        <span>${otherParticipant.username}</span>
+                        ${avatar(otherParticipants[0])}
+                        <span>${otherParticipants.map(p => p.username).join(', ')}</span>
+                        <small id="presence" class="presence"></small>
                     </div>
+                    <button id="leave-button" class="leave-button">Leave</button>
                 </div>
                 <ol id="messages" class="messages">${showLoadMoreButton
                 ? `<li class="load-more">
                     <button id="load-more-button" data-before="${lastMessage.id}">Load more</button>
                 </li>`
+                : ''}${showLoadNewerButton
+                ? `<li class="load-more">
+                    <button id="load-newer-button" data-after="${firstMessage.id}">Load newer</button>
+                </li>`
                 : ''}</ol>
+                <div id="typing-indicator" class="typing-indicator" hidden></div>
+                <div id="replying-to" class="replying-to" hidden>
+                    Replying to <span></span>
+                    <button class="cancel-reply-button" type="button">×</button>
+                </div>
                 <form id="message-form" class="message-form">
-                    <input type="text" placeholder="Type something" maxlength="480" required>
+                    <input type="text" placeholder="Type something" maxlength="480">
+                    <input type="file" multiple title="Attach files">
                     <button>Send</button>
                 </form>
             </div>
         `
         this.appendChild(template.content)
         this.backLink = /** @type {HTMLAnchorElement} */ (this.querySelector('#back-link'))
+        this.leaveButton = /** @type {HTMLButtonElement} */ (this.querySelector('#leave-button'))
         this.messagesOList = /** @type {HTMLOListElement} */ (this.querySelector('#messages'))
         this.loadMoreButton = /** @type {HTMLButtonElement=} */ (this.querySelector('#load-more-button'))
+        this.loadNewerButton = /** @type {HTMLButtonElement=} */ (this.querySelector('#load-newer-button'))
         this.messageForm = /** @type {HTMLFormElement} */ (this.querySelector('#message-form'))
-        this.messageInput = this.messageForm.querySelector('input')
+        this.typingIndicator = /** @type {HTMLDivElement} */ (this.querySelector('#typing-indicator'))
+        this.presenceEl = /** @type {HTMLElement} */ (this.querySelector('#presence'))
+        this.participants = participants
+        this.renderPresence()
+        this.replyingTo = /** @type {HTMLDivElement} */ (this.querySelector('#replying-to'))
+        this.replyingTo.onclick = this.onMessagesClick
+        this.messageInput = this.messageForm.querySelector('input[type="text"]')
+        this.fileInput = this.messageForm.querySelector('input[type="file"]')
         this.messageSubmitButton = this.messageForm.querySelector('button')
 
         this.backLink.onclick = this.onBackLinkClick
+        this.leaveButton.onclick = this.onLeaveClick
         this.messageForm.onsubmit = this.onMessageSubmit
+        this.messageInput.oninput = this.onMessageInput
+        this.messagesOList.ondblclick = this.onMessagesDblClick
+        this.messagesOList.oncontextmenu = this.onMessagesContextMenu
+        this.messagesOList.onclick = this.onMessagesClick
 
         if (showLoadMoreButton) {
             this.loadMoreButton.onclick = this.onLoadMoreClick
         }
 
+        if (showLoadNewerButton) {
+            this.loadNewerButton.onclick = this.onLoadNewerClick
+        }
+
+        const loadNewerLI = showLoadNewerButton ? this.loadNewerButton.parentElement : null
         for (const m of messages.reverse()) {
-            this.messagesOList.appendChild(renderMessage(m))
+            this.messagesOList.insertBefore(renderMessage(m), loadNewerLI)
         }
 
         setTimeout(() => {
+            const target = around !== null
+                ? this.messagesOList.querySelector(`.message[data-id="${around}"]`)
+                : null
+            if (target !== null) {
+                target.classList.add('highlighted')
+                target.scrollIntoView({ block: 'center' })
+                return
+            }
+
             this.messagesOList.scrollTop = this.messagesOList.scrollHeight
         })
     }
 
     disconnectedCallback() {
+        for (const entry of this.typingUsers.values()) {
+            clearTimeout(entry.timeout)
+        }
+        this.typingUsers.clear()
+
         if (typeof this.unsubscribeFromMessages === 'function') {
             this.unsubscribeFromMessages()
         }
@@ -179,54 +566,224 @@ export default params => new ConversationPage(params[0])
 /**
  * @param {string} conversationId
  */
-function getOtherParticipantFromConversation(conversationId) {
-    return http.get(`/api/conversations/${conversationId}/other_participant`)
+function getParticipants(conversationId) {
+    return http.get(`/api/conversations/${conversationId}/participants`)
 }
 
 /**
  * @param {string} conversationId
- * @param {string=} before
+ * @param {{before?:string,after?:string,around?:string}=} params
+ * @returns {Promise<{messages:object[],hasMoreBefore:boolean,hasMoreAfter:boolean}>}
  */
-function getMessages(conversationId, before) {
-    let url = `/api/conversations/${conversationId}/messages`
-    if (typeof before === 'string' && before !== '') {
-        url += '?before=' + before
-    }
-    return http.get(url)
+function getMessages(conversationId, params = {}) {
+    const query = new URLSearchParams(params).toString()
+    return http.get(`/api/conversations/${conversationId}/messages` + (query !== '' ? '?' + query : ''))
 }
 
 
+/**
+ * Realtime messages are the same for every receiver,
+ * so the fields that depend on the viewer are set here.
+ */
+function normalizeMessage(message) {
+    message.mine = !message.system && message.user !== undefined && message.user.id === getAuthUser().id
+    if (message.mine && !message.status) {
+        message.status = 'sent'
+    }
+}
+
 function renderMessage(message) {
     const li = document.createElement('li')
     li.className = 'message'
+    li.dataset['id'] = message.id
+    if (message.system) {
+        li.classList.add('system')
+        li.innerHTML = `<p>${escapeHTML(message.content)}</p>`
+        return li
+    }
     if (message.mine) {
         li.classList.add('owned')
     }
     li.innerHTML = `
         <div class="buble">
+            ${!message.mine && message.user ? `<small class="author">${message.user.username}</small>` : ''}
+            ${message.replyTo ? `<blockquote class="reply-to">
+                <small>${message.replyTo.user.username}</small>
+                ${message.replyTo.deletedAt ? '<em>Message deleted</em>' : escapeHTML(message.replyTo.content)}
+            </blockquote>` : ''}
             <p>${linkify(escapeHTML(message.content))}</p>
+            ${(message.attachments || []).map(renderAttachment).join('')}
+        </div>
+        <time>${ago(message.createdAt)}${message.editedAt ? ' · Edited' : ''}</time>
+        ${message.mine && message.status ? renderStatus(message.status) : ''}
+        <div class="reactions">
+            ${(message.reactions || []).map(renderReaction).join('')}
+            <button class="add-reaction" title="Add reaction">+</button>
+            <button class="reply-button" title="Reply">↩</button>
         </div>
-        <time>${ago(message.createdAt)}</time>
     `
     return li
 }
 
+/**
+ * @param {{online: boolean, lastSeenAt?: string}=} presence
+ */
+function presenceText(presence) {
+    if (!presence) {
+        return ''
+    }
+    if (presence.online) {
+        return 'Online'
+    }
+    if (presence.lastSeenAt) {
+        return 'Last seen ' + ago(presence.lastSeenAt)
+    }
+    return ''
+}
+
+/**
+ * @param {'sent'|'delivered'|'read'} status
+ */
+function renderStatus(status) {
+    const label = status === 'sent' ? '✓' : '✓✓'
+    return `<small class="status ${status}" title="${status[0].toUpperCase() + status.substr(1)}">${label}</small>`
+}
+
+function renderAttachment(attachment) {
+    const token = encodeURIComponent(localStorage.getItem('token'))
+    const src = attachment.url + '?token=' + token
+    if (!attachment.contentType.startsWith('image/')) {
+        return `<a class="attachment" data-id="${attachment.id}" href="${src}" target="_blank" rel="noopener">📎 ${escapeHTML(attachment.filename)}</a>`
+    }
+
+    if (attachment.processing) {
+        return `<span class="attachment processing" data-id="${attachment.id}">Processing ${escapeHTML(attachment.filename)}...</span>`
+    }
+
+    if (attachment.processingFailed) {
+        return `<span class="attachment processing" data-id="${attachment.id}">Could not process ${escapeHTML(attachment.filename)}</span>`
+    }
+
+    // Unprocessed images like WebP have no dimensions.
+    const size = attachment.width !== undefined
+        ? ` width="${attachment.width}" height="${attachment.height}"`
+        : ''
+    const thumbnail = (attachment.thumbnails || []).find(t => t.size >= 480)
+        || (attachment.thumbnails || []).slice(-1)[0]
+    const img = thumbnail !== undefined
+        ? `<img src="${thumbnail.url}?token=${token}" width="${thumbnail.width}" height="${thumbnail.height}" alt="${escapeHTML(attachment.filename)}">`
+        : `<img src="${src}"${size} alt="${escapeHTML(attachment.filename)}">`
+    return `<a class="attachment" data-id="${attachment.id}" href="${src}" target="_blank" rel="noopener">${img}</a>`
+}
+
+function renderReaction(reaction) {
+    return `<button class="reaction${reaction.reacted ? ' reacted' : ''}" data-emoji="${escapeHTML(reaction.emoji)}">${escapeHTML(reaction.emoji)} <span>${reaction.count}</span></button>`
+}
+
+/**
+ * @param {HTMLElement} li
+ * @param {{emoji:string,count:number,reacted:boolean}} reaction
+ * @param {boolean} mine whether the reaction change was made by the auth user.
+ */
+function updateReaction(li, reaction, mine) {
+    const reactionsDiv = li.querySelector('.reactions')
+    const button = Array.from(reactionsDiv.querySelectorAll('.reaction'))
+        .find(b => b.dataset['emoji'] === reaction.emoji)
+    const reacted = mine
+        ? reaction.reacted
+        : button !== undefined && button.classList.contains('reacted')
+
+    const template = document.createElement('template')
+    template.innerHTML = renderReaction({ emoji: reaction.emoji, count: reaction.count, reacted })
+    const newButton = template.content.firstElementChild
+
+    if (reaction.count === 0) {
+        if (button !== undefined) {
+            button.remove()
+        }
+    } else if (button !== undefined) {
+        button.replaceWith(newButton)
+    } else {
+        reactionsDiv.insertBefore(newButton, reactionsDiv.querySelector('.add-reaction'))
+    }
+}
+
 /**
  * @param {string} content
  * @param {string} conversationId
+ * @param {string=} replyToId
+ * @param {string[]=} attachmentIds
  */
-function createMessage(content, conversationId) {
-    return http.post(`/api/conversations/${conversationId}/messages`, { content })
+function createMessage(content, conversationId, replyToId, attachmentIds) {
+    return http.post(`/api/conversations/${conversationId}/messages`, { content, replyToId, attachmentIds })
 }
 
 /**
- * @param {function} cb
+ * @param {string} conversationId
+ * @param {File} file
+ */
+function uploadAttachment(conversationId, file) {
+    return http.post(`/api/conversations/${conversationId}/attachments?filename=${encodeURIComponent(file.name)}`, file)
+}
+
+/**
+ * @param {string} conversationId
+ * @param {string} messageId
+ * @param {string} content
  */
-async function subscribeToMessages(cb) {
+function updateMessage(conversationId, messageId, content) {
+    return http.patch(`/api/conversations/${conversationId}/messages/${messageId}`, { content })
+}
+
+/**
+ * @param {string} conversationId
+ * @param {string} messageId
+ * @param {'me'|'everyone'} forWhom
+ */
+function deleteMessage(conversationId, messageId, forWhom) {
+    return http.delete(`/api/conversations/${conversationId}/messages/${messageId}?for=${forWhom}`)
+}
+
+/**
+ * @param {string} conversationId
+ * @param {string} messageId
+ * @param {string} emoji
+ */
+function addReaction(conversationId, messageId, emoji) {
+    return http.post(`/api/conversations/${conversationId}/messages/${messageId}/reactions`, { emoji })
+}
+
+/**
+ * @param {string} conversationId
+ * @param {string} messageId
+ * @param {string} emoji
+ */
+function removeReaction(conversationId, messageId, emoji) {
+    return http.delete(`/api/conversations/${conversationId}/messages/${messageId}/reactions?emoji=${encodeURIComponent(emoji)}`)
+}
+
+/**
+ * @param {{[eventType: string]: function}} listeners
+ */
+async function subscribeToMessages(listeners) {
     if (!('EventSource' in window)) {
         await loadEventSourcePolyfill()
     }
-    return http.subscribe('/api/messages', cb)
+    return http.subscribe('/api/messages', listeners)
+}
+
+/**
+ * @param {string} conversationId
+ */
+function sendTyping(conversationId) {
+    return http.post(`/api/conversations/${conversationId}/typing`)
+}
+
+/**
+ * @param {string} conversationId
+ */
+function leaveConversation(conversationId) {
+    return http.post(`/api/conversations/${conversationId}/leave`)
 }
 
 /**
@@ -1,4 +1,7 @@
+import { navigate } from 'https://unpkg.com/@nicolasparada/router@0.8.0/router.js';
+import { saveTokens } from '../auth.js';
 import http from '../http.js';
+import { getOAuthProviders, magicLinkForm, renderOAuthProvider } from './access-page.js';
 
 const template = document.createElement('template')
 template.innerHTML = `
@@ -8,11 +11,15 @@ template.innerHTML = `
             <input type="text" placeholder="Username" value="john" required>
             <button>Login</button>
         </form>
+        <ul id="oauth-providers" class="oauth-providers"></ul>
     </div>
 `
 
-export default function accessPage() {
+export default async function accessPage() {
+    const providers = await getOAuthProviders().catch(() => [])
     const page = /** @type {DocumentFragment} */ (template.content.cloneNode(true))
+    page.getElementById('oauth-providers').innerHTML = providers.map(renderOAuthProvider).join('')
+    page.querySelector('.container').appendChild(magicLinkForm())
     const loginForm = /** @type {HTMLFormElement} */ (page.getElementById('login-form'))
     const loginFormInput = loginForm.querySelector('input')
     const loginFormButton = loginForm.querySelector('button')
@@ -27,9 +34,12 @@ export default function accessPage() {
         loginFormButton.disabled = true
         try {
             const payload = await login(username)
+            if (payload.twoFactorRequired) {
+                navigate('/two-factor?token=' + encodeURIComponent(payload.twoFactorToken))
+                return
+            }
             localStorage.setItem('auth_user', JSON.stringify(payload.authUser))
-            localStorage.setItem('token', payload.token)
-            localStorage.setItem('expires_at', payload.expiresAt)
+            saveTokens(payload)
             loginForm.reset()
             location.reload()
         } catch (err) {
@@ -51,7 +61,7 @@ export default function accessPage() {
 
 /**
  * @param {string} username
- * @returns {Promise<{authUser:{id:string,username:string,avatarURL:string},token:string,expiresAt:string}>}
+ * @returns {Promise<{authUser:{id:string,username:string,avatarURL:string},twoFactorRequired?:boolean,twoFactorToken?:string} & import('../auth.js').AuthTokens>}
  */
 function login(username) {
     return http.post('/api/login', { username })
@@ -2,6 +2,7 @@ import { navigate } from 'https://unpkg.com/@nicolasparada/router@0.8.0/router.j
 import { getAuthUser } from '../auth.js';
 import http from '../http.js';
 import { ago, avatar, escapeHTML, loadEventSourcePolyfill } from '../shared.js';
+import { getOAuthProviders } from './access-page.js';
 
 // HomePage is a custom element
 // so it takes advantage of disconnectedCallback
@@ -11,19 +12,217 @@ class HomePage extends HTMLElement {
         super()
 
         this.searchingUsernames = false
+        this.unreadCount = { messages: 0, conversations: 0 }
 
         this.onLogoutClick = this.onLogoutClick.bind(this)
+        this.onHideLastSeenChange = this.onHideLastSeenChange.bind(this)
         this.onConversationSubmit = this.onConversationSubmit.bind(this)
+        this.onSearchSubmit = this.onSearchSubmit.bind(this)
         this.onUsernameInput = this.onUsernameInput.bind(this)
         this.onLoadMoreClick = this.onLoadMoreClick.bind(this)
         this.onMessageArrive = this.onMessageArrive.bind(this)
+        this.onConversationCreated = this.onConversationCreated.bind(this)
+        this.onConversationUpdated = this.onConversationUpdated.bind(this)
+        this.onParticipantRead = this.onParticipantRead.bind(this)
+        this.onSessionsClick = this.onSessionsClick.bind(this)
+        this.onLogoutEverywhereClick = this.onLogoutEverywhereClick.bind(this)
+        this.onSessionsRevoked = this.onSessionsRevoked.bind(this)
+        this.onIdentitiesClick = this.onIdentitiesClick.bind(this)
+        this.onTwoFactorClick = this.onTwoFactorClick.bind(this)
+        this.onTwoFactorSubmit = this.onTwoFactorSubmit.bind(this)
     }
 
-    onLogoutClick() {
+    async onLogoutClick() {
+        this.logoutButton.disabled = true
+        try {
+            await logout()
+        } catch (err) {
+            console.error(err)
+        }
         localStorage.clear()
         location.reload()
     }
 
+    /**
+     * @param {MouseEvent} ev
+     */
+    async onSessionsClick(ev) {
+        const button = ev.target
+        if (!(button instanceof HTMLButtonElement) || !button.classList.contains('revoke-session-button')) {
+            return
+        }
+
+        const li = button.closest('.session')
+        button.disabled = true
+        try {
+            await revokeSession(li.dataset['id'])
+            li.remove()
+        } catch (err) {
+            alert(err.message)
+            button.disabled = false
+        }
+    }
+
+    /**
+     * @param {MouseEvent} ev
+     */
+    async onIdentitiesClick(ev) {
+        const button = ev.target
+        if (!(button instanceof HTMLButtonElement)) {
+            return
+        }
+
+        const li = button.closest('.identity')
+        const provider = li.dataset['provider']
+        button.disabled = true
+
+        if (button.classList.contains('link-identity-button')) {
+            try {
+                const token = await http.token()
+                location.assign(`/api/oauth/${encodeURIComponent(provider)}?token=${encodeURIComponent(token)}`)
+            } catch (err) {
+                alert(err.message)
+                button.disabled = false
+            }
+            return
+        }
+
+        try {
+            await unlinkIdentity(provider)
+            li.outerHTML = renderIdentity({ name: provider, title: li.dataset['title'] }, false)
+        } catch (err) {
+            alert(err.statusCode === 422 ? err.body.errors.provider : err.message)
+            button.disabled = false
+        }
+    }
+
+    async onLogoutEverywhereClick() {
+        if (!confirm('Log out from every device?')) {
+            return
+        }
+
+        this.logoutEverywhereButton.disabled = true
+        try {
+            await revokeAllSessions()
+        } catch (err) {
+            alert(err.message)
+            this.logoutEverywhereButton.disabled = false
+            return
+        }
+        localStorage.clear()
+        location.reload()
+    }
+
+    onSessionsRevoked({ ids }) {
+        for (const id of ids) {
+            const li = this.querySelector(`.session[data-id="${id}"]`)
+            if (li === null) {
+                continue
+            }
+
+            if (li.classList.contains('current')) {
+                localStorage.clear()
+                location.reload()
+                return
+            }
+
+            li.remove()
+        }
+    }
+
+    /**
+     * @param {MouseEvent} ev
+     */
+    async onTwoFactorClick(ev) {
+        const button = ev.target
+        if (!(button instanceof HTMLButtonElement)) {
+            return
+        }
+
+        if (button.classList.contains('enable-two-factor-button')) {
+            button.disabled = true
+            try {
+                const enrollment = await enrollTwoFactor()
+                this.twoFactorDiv.innerHTML = renderTwoFactorEnrollment(enrollment)
+                const input = /** @type {HTMLInputElement} */ (this.twoFactorDiv.querySelector('input'))
+                input.oninput = () => {
+                    input.setCustomValidity('')
+                }
+                input.focus()
+            } catch (err) {
+                button.disabled = false
+                if (err.statusCode === 403) {
+                    if (confirm(err.message.trim() + '. Log out now?')) {
+                        this.onLogoutClick()
+                    }
+                    return
+                }
+
+                alert(err.message)
+            }
+            return
+        }
+
+        if (button.classList.contains('disable-two-factor-button')) {
+            const code = prompt('Enter a code from your authenticator app or a recovery code to disable two-factor authentication')
+            if (code === null || code.trim() === '') {
+                return
+            }
+
+            button.disabled = true
+            try {
+                await disableTwoFactor(code.trim())
+                this.twoFactorDiv.innerHTML = renderTwoFactor(false)
+            } catch (err) {
+                alert(err.statusCode === 422 ? err.body.errors.code : err.message)
+                button.disabled = false
+            }
+        }
+    }
+
+    /**
+     * @param {Event} ev
+     */
+    async onTwoFactorSubmit(ev) {
+        ev.preventDefault()
+
+        const form = ev.target
+        if (!(form instanceof HTMLFormElement)) {
+            return
+        }
+
+        const input = form.querySelector('input')
+        const button = form.querySelector('button')
+        input.disabled = true
+        button.disabled = true
+        try {
+            const { recoveryCodes } = await confirmTwoFactor(input.value.trim())
+            this.twoFactorDiv.innerHTML = renderRecoveryCodes(recoveryCodes) + renderTwoFactor(true)
+        } catch (err) {
+            input.disabled = false
+            button.disabled = false
+            if (err.statusCode === 422) {
+                input.setCustomValidity(err.body.errors.code)
+                input.reportValidity()
+            } else {
+                alert(err.message)
+            }
+        }
+    }
+
+    async onHideLastSeenChange() {
+        this.hideLastSeenCheckbox.disabled = true
+        try {
+            const settings = await updateSettings({ hideLastSeen: this.hideLastSeenCheckbox.checked })
+            this.hideLastSeenCheckbox.checked = settings.hideLastSeen
+        } catch (err) {
+            alert(err.message)
+            this.hideLastSeenCheckbox.checked = !this.hideLastSeenCheckbox.checked
+        } finally {
+            this.hideLastSeenCheckbox.disabled = false
+        }
+    }
+
     /**
      * @param {Event} ev
      */
@@ -33,12 +232,12 @@ class HomePage extends HTMLElement {
         this.usernameInput.disabled = true
 
         try {
-            const conversation = await createConversation(this.usernameInput.value)
+            const conversation = await createConversation(this.usernameInput.value.split(','))
             this.usernameInput.value = ''
             navigate('/conversations/' + conversation.id)
         } catch (err) {
             if (err.statusCode === 422) {
-                this.usernameInput.setCustomValidity(err.body.errors.username)
+                this.usernameInput.setCustomValidity(err.body.errors.usernames)
             } else {
                 alert(err.message)
             }
@@ -50,6 +249,31 @@ class HomePage extends HTMLElement {
         }
     }
 
+    /**
+     * @param {Event} ev
+     */
+    async onSearchSubmit(ev) {
+        ev.preventDefault()
+
+        const q = this.searchInput.value.trim()
+        if (q === '') {
+            this.searchResultsOList.innerHTML = ''
+            return
+        }
+
+        this.searchInput.disabled = true
+        try {
+            const { results } = await searchMessages(q)
+            this.searchResultsOList.innerHTML = results.length === 0
+                ? '<li>No messages found</li>'
+                : results.map(renderSearchResult).join('')
+        } catch (err) {
+            alert(err.message)
+        } finally {
+            this.searchInput.disabled = false
+        }
+    }
+
     /**
      * @param {Event} ev
      */
@@ -58,21 +282,24 @@ class HomePage extends HTMLElement {
             return
         }
 
-        const search = this.usernameInput.value.trim()
+        const usernames = this.usernameInput.value.split(',')
+        const search = usernames.pop().trim()
 
         if (search === '') {
             return
         }
 
+        const prefix = usernames.map(username => username.trim() + ', ').join('')
+
         this.searchingUsernames = true
-        const usernames = await searchUsernames(search).catch(err => {
+        const results = await searchUsernames(search).catch(err => {
             console.error(err)
             return []
         })
         this.searchingUsernames = false
 
-        this.usernamesDataList.innerHTML = usernames
-            .map(username => `<option value="${username}">${username}</option>`)
+        this.usernamesDataList.innerHTML = results
+            .map(username => `<option value="${prefix + username}">${username}</option>`)
             .join('')
     }
 
@@ -108,18 +335,33 @@ class HomePage extends HTMLElement {
     }
 
     async onMessageArrive(message) {
+        // Sent from another of my devices.
+        message.mine = !message.system && message.user !== undefined && message.user.id === getAuthUser().id
+
         const conversationLI = this.querySelector(`.conversation[data-id="${message.conversationId}"]`)
+        const unread = !message.mine && !message.system
+        if (unread) {
+            this.setUnreadCount({
+                messages: this.unreadCount.messages + 1,
+                conversations: this.unreadCount.conversations + (conversationLI === null || !conversationLI.classList.contains('has-unread-messages') ? 1 : 0),
+            })
+        }
+
         if (conversationLI !== null) {
-            conversationLI.classList.add('has-unread-messages')
-            conversationLI.querySelector('.message-preview p').textContent = message.content
+            if (unread) {
+                conversationLI.classList.add('has-unread-messages')
+                const badge = conversationLI.querySelector('.unread-count')
+                badge.textContent = String(Number(badge.textContent) + 1)
+            }
+            conversationLI.querySelector('.message-preview p').textContent = (message.mine ? 'You: ' : '') + message.content
             conversationLI.querySelector('.message-preview time').textContent = ago(message.createdAt)
+            this.conversationsOList.insertAdjacentElement('afterbegin', conversationLI)
             return
         }
 
         let conversation
         try {
             conversation = await getConversation(message.conversationId)
-            conversation.hasUnreadMessages = true
             conversation.lastMessage = message
         } catch (err) {
             console.error(err)
@@ -129,9 +371,81 @@ class HomePage extends HTMLElement {
         this.conversationsOList.insertAdjacentElement('afterbegin', renderConversation(conversation))
     }
 
+    onConversationCreated(conversation) {
+        if (this.querySelector(`.conversation[data-id="${conversation.id}"]`) !== null) {
+            return
+        }
+
+        conversation.lastMessage = null
+        this.conversationsOList.insertAdjacentElement('afterbegin', renderConversation(conversation))
+    }
+
+    onConversationUpdated(conversation) {
+        const conversationLI = this.querySelector(`.conversation[data-id="${conversation.id}"]`)
+        if (conversationLI === null) {
+            return
+        }
+
+        const authUser = getAuthUser()
+        if (!conversation.participants.some(p => p.id === authUser.id)) {
+            this.onParticipantRead({ conversationId: conversation.id, userId: authUser.id })
+            conversationLI.remove()
+            return
+        }
+
+        const otherParticipants = conversation.participants.filter(p => p.id !== authUser.id)
+        conversationLI.querySelector('.avatar-wrapper span').textContent = otherParticipants.map(p => p.username).join(', ')
+    }
+
+    onParticipantRead({ conversationId, userId }) {
+        if (userId !== getAuthUser().id) {
+            return
+        }
+
+        const conversationLI = this.querySelector(`.conversation[data-id="${conversationId}"]`)
+        if (conversationLI === null || !conversationLI.classList.contains('has-unread-messages')) {
+            return
+        }
+
+        const badge = conversationLI.querySelector('.unread-count')
+        this.setUnreadCount({
+            messages: Math.max(this.unreadCount.messages - Number(badge.textContent), 0),
+            conversations: Math.max(this.unreadCount.conversations - 1, 0),
+        })
+        conversationLI.classList.remove('has-unread-messages')
+        badge.textContent = '0'
+    }
+
+    /**
+     * @param {{messages: number, conversations: number}} unreadCount
+     */
+    setUnreadCount(unreadCount) {
+        this.unreadCount = unreadCount
+        if (this.unreadBadge === undefined) {
+            return
+        }
+
+        this.unreadBadge.hidden = unreadCount.messages === 0
+        this.unreadBadge.textContent = String(unreadCount.messages)
+        this.unreadBadge.title = `${unreadCount.messages} unread messages in ${unreadCount.conversations} conversations`
+    }
+
     async connectedCallback() {
-        const conversations = await getConversations().catch(() => [])
-        this.unsubscribeFromMessages = await subscribeToMessages(this.onMessageArrive)
+        const [conversations, unreadCount, settings, sessions, providers, identities] = await Promise.all([
+            getConversations().catch(() => []),
+            getUnreadCount().catch(() => ({ messages: 0, conversations: 0 })),
+            getSettings().catch(() => ({ hideLastSeen: false, twoFactorEnabled: false })),
+            getSessions().catch(() => []),
+            getOAuthProviders().catch(() => []),
+            getIdentities().catch(() => []),
+        ])
+        this.unsubscribeFromMessages = await subscribeToMessages({
+            'message.created': this.onMessageArrive,
+            'conversation.created': this.onConversationCreated,
+            'conversation.updated': this.onConversationUpdated,
+            'participant.read': this.onParticipantRead,
+            'sessions.revoked': this.onSessionsRevoked,
+        })
 
         const conversationsLength = conversations.length
         const showLoadMoreButton = conversationsLength === 25
@@ -147,10 +461,37 @@ class HomePage extends HTMLElement {
                         <span>${authUser.username}</span>
                         <button id="logout-button" class="logout-button">Logout</button>
                     </div>
+                    <label class="setting">
+                        <input id="hide-last-seen-checkbox" type="checkbox"${settings.hideLastSeen ? ' checked' : ''}>
+                        Hide last seen
+                    </label>
+                    <details class="sessions-wrapper">
+                        <summary>Sessions</summary>
+                        <ol id="sessions" class="sessions">
+                            ${sessions.map(renderSession).join('')}
+                        </ol>
+                        <button id="logout-everywhere-button">Log out everywhere</button>
+                    </details>
+                    <details class="identities-wrapper">
+                        <summary>Linked accounts</summary>
+                        <ul id="identities" class="identities">
+                            ${providers.map(p => renderIdentity(p, identities.some(i => i.provider === p.name))).join('')}
+                        </ul>
+                    </details>
+                    <details class="two-factor-wrapper">
+                        <summary>Two-factor authentication</summary>
+                        <div id="two-factor">
+                            ${renderTwoFactor(settings.twoFactorEnabled)}
+                        </div>
+                    </details>
                 </section>
-                <h2>Conversations</h2>
+                <h2>Conversations <span id="unread-badge" class="unread-count" hidden></span></h2>
+                <form id="search-form" class="search-form">
+                    <input id="search-input" type="search" placeholder="Search messages...">
+                </form>
+                <ol id="search-results" class="search-results"></ol>
                 <form id="conversation-form">
-                    <input id="username-input" type="search" placeholder="Start conversation with..." list="usernames-datalist" required>
+                    <input id="username-input" type="search" placeholder="Start conversation with... (comma separated)" list="usernames-datalist" required>
                     <datalist id="usernames-datalist"></datalist>
                 </form>
                 <ol id="conversations" class="conversations"></ol>
@@ -162,13 +503,29 @@ class HomePage extends HTMLElement {
         this.appendChild(template.content)
         this.logoutButton = /** @type {HTMLButtonElement} */ (this.querySelector('#logout-button'))
         this.conversationForm = /** @type {HTMLFormElement} */ (this.querySelector('#conversation-form'))
+        this.searchForm = /** @type {HTMLFormElement} */ (this.querySelector('#search-form'))
+        this.searchInput = /** @type {HTMLInputElement} */ (this.querySelector('#search-input'))
+        this.searchResultsOList = /** @type {HTMLOListElement} */ (this.querySelector('#search-results'))
         this.usernameInput = /** @type {HTMLInputElement} */ (this.querySelector('#username-input'))
         this.usernamesDataList = /** @type {HTMLDataListElement} */ (this.querySelector('#usernames-datalist'))
         this.conversationsOList = /** @type {HTMLOListElement} */ (this.querySelector('#conversations'))
         this.loadMoreButton = /** @type {HTMLButtonElement=} */ (this.querySelector('#load-more-button'))
+        this.unreadBadge = /** @type {HTMLSpanElement} */ (this.querySelector('#unread-badge'))
+        this.setUnreadCount(unreadCount)
 
+        this.hideLastSeenCheckbox = /** @type {HTMLInputElement} */ (this.querySelector('#hide-last-seen-checkbox'))
+        this.sessionsOList = /** @type {HTMLOListElement} */ (this.querySelector('#sessions'))
+        this.logoutEverywhereButton = /** @type {HTMLButtonElement} */ (this.querySelector('#logout-everywhere-button'))
         this.logoutButton.onclick = this.onLogoutClick
+        this.sessionsOList.onclick = this.onSessionsClick
+        this.querySelector('#identities').addEventListener('click', this.onIdentitiesClick)
+        this.twoFactorDiv = /** @type {HTMLDivElement} */ (this.querySelector('#two-factor'))
+        this.twoFactorDiv.addEventListener('click', this.onTwoFactorClick)
+        this.twoFactorDiv.addEventListener('submit', this.onTwoFactorSubmit)
+        this.logoutEverywhereButton.onclick = this.onLogoutEverywhereClick
+        this.hideLastSeenCheckbox.onchange = this.onHideLastSeenChange
         this.conversationForm.onsubmit = this.onConversationSubmit
+        this.searchForm.onsubmit = this.onSearchSubmit
         this.usernameInput.oninput = this.onUsernameInput
 
         for (const c of conversations) {
@@ -202,14 +559,148 @@ function getConversations(before) {
     return http.get(url)
 }
 
+function getSettings() {
+    return http.get('/api/settings')
+}
+
+/**
+ * @param {{hideLastSeen?: boolean}} settings
+ */
+function updateSettings(settings) {
+    return http.patch('/api/settings', settings)
+}
+
+function getUnreadCount() {
+    return http.get('/api/unread_count')
+}
+
+function getSessions() {
+    return http.get('/api/sessions')
+}
+
+/**
+ * @param {string} id
+ */
+function revokeSession(id) {
+    return http.delete('/api/sessions/' + encodeURIComponent(id))
+}
+
+function revokeAllSessions() {
+    return http.delete('/api/sessions')
+}
+
+function getIdentities() {
+    return http.get('/api/identities')
+}
+
+/**
+ * @param {string} provider
+ */
+function unlinkIdentity(provider) {
+    return http.delete('/api/identities/' + encodeURIComponent(provider))
+}
+
 /**
- * @param {string} username
+ * @param {{name:string,title:string}} provider
+ * @param {boolean} linked
  */
-function createConversation(username) {
-    return http.post('/api/conversations', { username })
+function renderIdentity(provider, linked) {
+    return `
+        <li class="identity" data-provider="${escapeHTML(provider.name)}" data-title="${escapeHTML(provider.title)}">
+            <span>${escapeHTML(provider.title)}</span>
+            ${linked
+            ? '<button class="unlink-identity-button">Unlink</button>'
+            : '<button class="link-identity-button">Link</button>'}
+        </li>
+    `
+}
+
+/**
+ * @returns {Promise<{secret:string,provisioningURI:string}>}
+ */
+function enrollTwoFactor() {
+    return http.post('/api/two_factor/enroll')
+}
+
+/**
+ * @param {string} code
+ * @returns {Promise<{recoveryCodes:string[]}>}
+ */
+function confirmTwoFactor(code) {
+    return http.post('/api/two_factor/confirm', { code })
+}
+
+/**
+ * @param {string} code
+ */
+function disableTwoFactor(code) {
+    return http.post('/api/two_factor/disable', { code })
+}
+
+/**
+ * @param {boolean} enabled
+ */
+function renderTwoFactor(enabled) {
+    return enabled
+        ? '<p>Enabled. <button class="disable-two-factor-button">Disable</button></p>'
+        : '<p>Disabled. <button class="enable-two-factor-button">Enable</button></p>'
+}
+
+/**
+ * @param {{secret:string,provisioningURI:string}} enrollment
+ */
+function renderTwoFactorEnrollment(enrollment) {
+    return `
+        <p>
+            Scan or open <a href="${escapeHTML(enrollment.provisioningURI)}">this link</a> with your authenticator app,
+            or enter the key <code>${escapeHTML(enrollment.secret)}</code> manually.
+            Then type the code it shows.
+        </p>
+        <form class="two-factor-form">
+            <input type="text" inputmode="numeric" placeholder="123456" autocomplete="one-time-code" required>
+            <button>Confirm</button>
+        </form>
+    `
+}
+
+/**
+ * @param {string[]} codes
+ */
+function renderRecoveryCodes(codes) {
+    return `
+        <p>Save these recovery codes somewhere safe. Each one works once in place of a code from your app.</p>
+        <ul class="recovery-codes">
+            ${codes.map(c => `<li><code>${escapeHTML(c)}</code></li>`).join('')}
+        </ul>
+    `
+}
+
+function logout() {
+    return http.post('/api/logout')
+}
+
+function renderSession(session) {
+    return `
+        <li class="session${session.current ? ' current' : ''}" data-id="${session.id}">
+            <div>
+                <strong>${escapeHTML(session.device)}</strong>${session.current ? ' <small>(this device)</small>' : ''}
+                <small title="${escapeHTML(session.userAgent)}">${escapeHTML(session.ip)} · active ${ago(session.lastUsedAt)}</small>
+            </div>
+            ${session.current ? '' : '<button class="revoke-session-button">Log out</button>'}
+        </li>
+    `
+}
+
+/**
+ * @param {string[]} usernames
+ */
+function createConversation(usernames) {
+    return http.post('/api/conversations', { usernames })
 }
 
 function renderConversation(conversation) {
+    const authUser = getAuthUser()
+    const otherParticipants = conversation.participants.filter(p => p.id !== authUser.id)
     const li = document.createElement('li')
     li.className = 'conversation'
     li.dataset['id'] = conversation.id
@@ -219,30 +710,59 @@ function renderConversation(conversation) {
     li.innerHTML = `
         <a href="/conversations/${conversation.id}">
             <div class="avatar-wrapper">
-                ${avatar(conversation.otherParticipant)}
-                <span>${conversation.otherParticipant.username}</span>
+                ${avatar(otherParticipants[0])}
+                <span>${otherParticipants.map(p => p.username).join(', ')}</span>
+                <span class="unread-count">${conversation.unreadMessagesCount}</span>
             </div>
-            <div class="message-preview">
+            <div class="message-preview">${conversation.lastMessage ? `
                 <p>${conversation.lastMessage.mine ? 'You: ' : ''}${escapeHTML(conversation.lastMessage.content)}</p>
-                <time>${ago(conversation.lastMessage.createdAt)}</time>
+                <time>${ago(conversation.lastMessage.createdAt)}</time>` : `
+                <p>No messages yet</p>
+                <time></time>`}
             </div>
         </a>
     `
     return li
 }
 
+/**
+ * @param {string} q
+ */
+function searchMessages(q) {
+    return http.get('/api/messages/search?q=' + encodeURIComponent(q))
+}
+
+function renderSearchResult(result) {
+    let snippet = ''
+    let last = 0
+    const chars = Array.from(result.snippet)
+    for (const h of result.highlights) {
+        snippet += escapeHTML(chars.slice(last, h.start).join(''))
+        snippet += `<mark>${escapeHTML(chars.slice(h.start, h.end).join(''))}</mark>`
+        last = h.end
+    }
+    snippet += escapeHTML(chars.slice(last).join(''))
+
+    return `<li class="search-result">
+        <a href="/conversations/${result.conversationId}?message=${result.message.id}">
+            <small>${escapeHTML(result.message.user.username)} · ${ago(result.message.createdAt)}</small>
+            <p>${snippet}</p>
+        </a>
+    </li>`
+}
+
 function searchUsernames(search) {
     return http.get('/api/usernames?search=' + search)
 }
 
 /**
- * @param {function} cb
+ * @param {{[eventType: string]: function}} listeners
  */
-async function subscribeToMessages(cb) {
+async function subscribeToMessages(listeners) {
     if (!('EventSource' in window)) {
         await loadEventSourcePolyfill()
     }
-    return http.subscribe('/api/messages', cb)
+    return http.subscribe('/api/messages', listeners)
 }
 
 function getConversation(id) {
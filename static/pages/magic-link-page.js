@@ -0,0 +1,34 @@
+import { navigate } from 'https://unpkg.com/@nicolasparada/router@0.8.0/router.js';
+import { saveTokens } from '../auth.js';
+import http from '../http.js';
+
+export default async function magicLinkPage() {
+    const url = new URL(location.toString())
+    const token = url.searchParams.get('token')
+
+    try {
+        if (token === null) {
+            throw new Error('Invalid URL')
+        }
+
+        const payload = await magicLinkLogin(token)
+        if (payload.twoFactorRequired) {
+            navigate('/two-factor?token=' + encodeURIComponent(payload.twoFactorToken), true)
+            return
+        }
+
+        localStorage.setItem('auth_user', JSON.stringify(payload.authUser))
+        saveTokens(payload)
+    } catch (err) {
+        alert(err.message)
+    }
+    navigate('/', true)
+}
+
+/**
+ * @param {string} token
+ * @returns {Promise<{authUser:{id:string,username:string,avatarURL:string},twoFactorRequired?:boolean,twoFactorToken?:string} & import('../auth.js').AuthTokens>}
+ */
+function magicLinkLogin(token) {
+    return http.post('/api/magic_link_login', { token })
+}
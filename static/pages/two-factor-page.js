@@ -0,0 +1,73 @@
+import { navigate } from 'https://unpkg.com/@nicolasparada/router@0.8.0/router.js';
+import { saveTokens } from '../auth.js';
+import http from '../http.js';
+
+const template = document.createElement('template')
+template.innerHTML = `
+    <div class="container">
+        <h1>Two-factor authentication</h1>
+        <form id="two-factor-form" class="two-factor-form">
+            <input type="text" placeholder="Code or recovery code" autocomplete="one-time-code" autocapitalize="off" required autofocus>
+            <button>Verify</button>
+        </form>
+    </div>
+`
+
+export default function twoFactorPage() {
+    const token = new URL(location.toString()).searchParams.get('token')
+    if (token === null) {
+        navigate('/', true)
+        return
+    }
+
+    const page = /** @type {DocumentFragment} */ (template.content.cloneNode(true))
+    const form = /** @type {HTMLFormElement} */ (page.getElementById('two-factor-form'))
+    const input = form.querySelector('input')
+    const button = form.querySelector('button')
+
+    input.addEventListener('input', () => {
+        input.setCustomValidity('')
+    })
+
+    /**
+     * @param {Event} ev
+     */
+    const onFormSubmit = async ev => {
+        ev.preventDefault()
+        input.disabled = true
+        button.disabled = true
+        try {
+            const payload = await twoFactorLogin(token, input.value.trim())
+            localStorage.setItem('auth_user', JSON.stringify(payload.authUser))
+            saveTokens(payload)
+            navigate('/', true)
+        } catch (err) {
+            if (err.statusCode === 422) {
+                input.setCustomValidity(err.body.errors.code)
+                input.reportValidity()
+            } else {
+                alert(err.message)
+                if (err.statusCode === 401) {
+                    navigate('/', true)
+                }
+            }
+        } finally {
+            input.disabled = false
+            button.disabled = false
+            input.focus()
+        }
+    }
+
+    form.addEventListener('submit', onFormSubmit)
+
+    return page
+}
+
+/**
+ * @param {string} token
+ * @param {string} code
+ * @returns {Promise<{authUser:{id:string,username:string,avatarURL:string}} & import('../auth.js').AuthTokens>}
+ */
+function twoFactorLogin(token, code) {
+    return http.post('/api/two_factor/login', { token, code })
+}
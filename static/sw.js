@@ -1,4 +1,4 @@
-const VERSION = 3
+const VERSION = 9
 const staticCacheName = `static-v${VERSION}`
 const staticUrlsToCache = [
     'https://unpkg.com/@nicolasparada/router@0.8.0/router.js',
@@ -7,7 +7,9 @@ const staticUrlsToCache = [
     '/pages/callback-page.js',
     '/pages/conversation-page.js',
     '/pages/home-page.js',
+    '/pages/magic-link-page.js',
     '/pages/not-found-page.js',
+    '/pages/two-factor-page.js',
     '/auth.js',
     '/http.js',
     '/index.html',
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+const (
+	// totpPeriod in seconds each code lasts.
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many periods before and after the current one
+	// are accepted to tolerate clock drift.
+	totpSkew = 1
+
+	recoveryCodesCount    = 10
+	recoveryCodesAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+	// freshLoginLifetime is how recent the session must be
+	// to turn on two-factor authentication,
+	// so a leaked token alone can't lock the owner out.
+	freshLoginLifetime = time.Minute * 10
+
+	// twoFactorLoginLifetime is how long users have
+	// to enter their code after the first login step.
+	twoFactorLoginLifetime = time.Minute * 5
+
+	// maxCodeAttempts failed in a row lock code attempts
+	// for that user during codeAttemptsLockout.
+	maxCodeAttempts     = 5
+	codeAttemptsLockout = time.Minute * 15
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactorEnrollment with what authenticator apps need.
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	// ProvisioningURI to show as a QR code.
+	ProvisioningURI string `json:"provisioningURI"`
+}
+
+// twoFactorLogin is the payload of the signed token
+// handed out in between the two login steps.
+type twoFactorLogin struct {
+	UserID    string
+	ExpiresAt time.Time
+}
+
+var twoFactorSigner *securecookie.SecureCookie
+
+// totpCipher encrypts TOTP secrets at rest.
+var totpCipher cipher.AEAD
+
+// POST /api/two_factor/enroll
+func enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+
+	if !freshLogin(w, r) {
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	var username string
+	var enabled bool
+	if err = tx.QueryRowContext(ctx, `
+		SELECT username, totp_enabled FROM users WHERE id = $1 FOR UPDATE
+	`, uid).Scan(&username, &enabled); err != nil {
+		respondError(w, fmt.Errorf("could not query user: %w", err))
+		return
+	}
+
+	if enabled {
+		http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+		return
+	}
+
+	b := make([]byte, 20)
+	if _, err = rand.Read(b); err != nil {
+		respondError(w, fmt.Errorf("could not generate totp secret: %w", err))
+		return
+	}
+
+	secret := totpEncoding.EncodeToString(b)
+	sealed, err := sealTOTPSecret(uid, secret)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	// Not enabled until confirmed with a code.
+	if _, err = tx.ExecContext(ctx, `
+		UPDATE users SET totp_secret = $1, totp_last_step = 0 WHERE id = $2
+	`, sealed, uid); err != nil {
+		respondError(w, fmt.Errorf("could not update totp secret: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to enroll two-factor: %w", err))
+		return
+	}
+
+	respond(w, TwoFactorEnrollment{
+		Secret:          secret,
+		ProvisioningURI: totpProvisioningURI(username, secret),
+	}, http.StatusOK)
+}
+
+// POST /api/two_factor/confirm
+func confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+
+	if !freshLogin(w, r) {
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	retryAfter, err := reserveCodeAttempt(ctx, tx, uid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not reserve code attempt: %w", err))
+		return
+	}
+
+	if retryAfter > 0 {
+		respondTooManyCodeAttempts(w, retryAfter)
+		return
+	}
+
+	var sealed []byte
+	var enabled bool
+	var lastStep int64
+	if err = tx.QueryRowContext(ctx, `
+		SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1 FOR UPDATE
+	`, uid).Scan(&sealed, &enabled, &lastStep); err != nil {
+		respondError(w, fmt.Errorf("could not query totp secret: %w", err))
+		return
+	}
+
+	if enabled {
+		http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+		return
+	}
+
+	if sealed == nil {
+		http.Error(w, "Enroll first", http.StatusConflict)
+		return
+	}
+
+	secret, err := openTOTPSecret(uid, sealed)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	step, ok := validateTOTP(secret, in.Code, time.Now(), lastStep)
+	if !ok {
+		respondInvalidCode(w, tx)
+		return
+	}
+
+	if err = codeAttemptsReset(ctx, tx, uid); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		UPDATE users SET totp_enabled = true, totp_last_step = $1 WHERE id = $2
+	`, step, uid); err != nil {
+		respondError(w, fmt.Errorf("could not enable two-factor: %w", err))
+		return
+	}
+
+	codes, err := insertRecoveryCodes(ctx, tx, uid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not insert recovery codes: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to confirm two-factor: %w", err))
+		return
+	}
+
+	respond(w, map[string]interface{}{
+		"recoveryCodes": codes,
+	}, http.StatusOK)
+}
+
+// POST /api/two_factor/disable
+func disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	retryAfter, err := reserveCodeAttempt(ctx, tx, uid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not reserve code attempt: %w", err))
+		return
+	}
+
+	if retryAfter > 0 {
+		respondTooManyCodeAttempts(w, retryAfter)
+		return
+	}
+
+	ok, err := verifySecondFactor(ctx, tx, uid, in.Code)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not verify code: %w", err))
+		return
+	}
+
+	if !ok {
+		respondInvalidCode(w, tx)
+		return
+	}
+
+	if err = codeAttemptsReset(ctx, tx, uid); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		UPDATE users SET totp_enabled = false, totp_secret = NULL, totp_last_step = 0 WHERE id = $1
+	`, uid); err != nil {
+		respondError(w, fmt.Errorf("could not disable two-factor: %w", err))
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		DELETE FROM recovery_codes WHERE user_id = $1
+	`, uid); err != nil {
+		respondError(w, fmt.Errorf("could not delete recovery codes: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to disable two-factor: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/two_factor/login
+func twoFactorLoginStep(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Token string `json:"token"`
+		Code  string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var tfl twoFactorLogin
+	if err := twoFactorSigner.Decode("two_factor_login", in.Token, &tfl); err != nil || !tfl.ExpiresAt.After(time.Now()) {
+		http.Error(w, "Invalid or expired login, start again", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	retryAfter, err := reserveCodeAttempt(ctx, tx, tfl.UserID)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not reserve code attempt: %w", err))
+		return
+	}
+
+	if retryAfter > 0 {
+		respondTooManyCodeAttempts(w, retryAfter)
+		return
+	}
+
+	ok, err := verifySecondFactor(ctx, tx, tfl.UserID, in.Code)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not verify code: %w", err))
+		return
+	}
+
+	if !ok {
+		respondInvalidCode(w, tx)
+		return
+	}
+
+	if err = codeAttemptsReset(ctx, tx, tfl.UserID); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	user, err := queryUser(ctx, tx, tfl.UserID)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query user: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to verify code: %w", err))
+		return
+	}
+
+	tokens, err := startSession(ctx, user.ID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		respondError(w, fmt.Errorf("could not start session: %w", err))
+		return
+	}
+
+	respondWithTokens(w, user, tokens)
+}
+
+// twoFactorChallenge returns a token to finish logging in with a code
+// when the user has two-factor authentication enabled, or empty otherwise.
+func twoFactorChallenge(ctx context.Context, uid string) (string, error) {
+	var enabled bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT totp_enabled FROM users WHERE id = $1
+	`, uid).Scan(&enabled); err != nil {
+		return "", fmt.Errorf("could not query two-factor enabled: %w", err)
+	}
+
+	if !enabled {
+		return "", nil
+	}
+
+	token, err := twoFactorSigner.Encode("two_factor_login", twoFactorLogin{
+		UserID:    uid,
+		ExpiresAt: time.Now().Add(twoFactorLoginLifetime),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not encode two-factor login: %w", err)
+	}
+
+	return token, nil
+}
+
+// verifySecondFactor checks the code against the authenticator of the user
+// or its unused recovery codes, which work once each.
+func verifySecondFactor(ctx context.Context, tx *sql.Tx, uid, code string) (bool, error) {
+	var sealed []byte
+	var lastStep int64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT totp_secret, totp_last_step FROM users
+		WHERE id = $1 AND totp_enabled = true
+		FOR UPDATE
+	`, uid).Scan(&sealed, &lastStep); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not query totp secret: %w", err)
+	}
+
+	secret, err := openTOTPSecret(uid, sealed)
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := validateTOTP(secret, code, time.Now(), lastStep); ok {
+		// Each code works once.
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE users SET totp_last_step = $1 WHERE id = $2
+		`, step, uid); err != nil {
+			return false, fmt.Errorf("could not update totp last step: %w", err)
+		}
+
+		return true, nil
+	}
+
+	code = normalizeRecoveryCode(code)
+	if code == "" {
+		return false, nil
+	}
+
+	var used bool
+	if err := tx.QueryRowContext(ctx, `
+		UPDATE recovery_codes SET used_at = now()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+		RETURNING true
+	`, uid, hashRecoveryCode(code)).Scan(&used); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not use recovery code: %w", err)
+	}
+
+	return true, nil
+}
+
+// insertRecoveryCodes replaces the recovery codes of the user.
+// Only their hashes are stored, so they are shown once.
+func insertRecoveryCodes(ctx context.Context, tx *sql.Tx, uid string) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM recovery_codes WHERE user_id = $1
+	`, uid); err != nil {
+		return nil, fmt.Errorf("could not delete old recovery codes: %w", err)
+	}
+
+	codes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		code, err := gonanoid.Generate(recoveryCodesAlphabet, 10)
+		if err != nil {
+			return nil, fmt.Errorf("could not generate recovery code: %w", err)
+		}
+
+		codes[i] = code[:5] + "-" + code[5:]
+
+		if _, err = tx.ExecContext(ctx, `
+			INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)
+		`, uid, hashRecoveryCode(code)); err != nil {
+			return nil, fmt.Errorf("could not insert recovery code: %w", err)
+		}
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode so it matches with or without dashes, spaces or caps.
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+}
+
+func hashRecoveryCode(code string) []byte {
+	h := sha256.Sum256([]byte(code))
+	return h[:]
+}
+
+// totpProvisioningURI for authenticator apps.
+func totpProvisioningURI(username, secret string) string {
+	q := make(url.Values)
+	q.Set("secret", secret)
+	q.Set("issuer", "Messenger")
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(totpDigits))
+	q.Set("period", strconv.Itoa(totpPeriod))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/Messenger:" + username,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// freshLogin checks the session of the request started recently.
+// It responds with 403 otherwise.
+func freshLogin(w http.ResponseWriter, r *http.Request) bool {
+	ctx := r.Context()
+	sid := ctx.Value(keyAuthSessionID).(string)
+
+	var fresh bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT created_at > now() - $1 * INTERVAL '1 second' FROM sessions WHERE id = $2
+	`, int(freshLoginLifetime.Seconds()), sid).Scan(&fresh); err != nil && err != sql.ErrNoRows {
+		respondError(w, fmt.Errorf("could not query session: %w", err))
+		return false
+	}
+
+	if !fresh {
+		http.Error(w, "Log in again to turn on two-factor authentication", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// newTOTPCipher derives an AES-256 key from the server key.
+func newTOTPCipher(key string) (cipher.AEAD, error) {
+	k := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return nil, fmt.Errorf("could not create totp secret cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealTOTPSecret encrypts the secret, bound to the user
+// so it can't be copied over to another one.
+func sealTOTPSecret(uid, secret string) ([]byte, error) {
+	nonce := make([]byte, totpCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("could not generate totp secret nonce: %w", err)
+	}
+
+	return totpCipher.Seal(nonce, nonce, []byte(secret), []byte(uid)), nil
+}
+
+func openTOTPSecret(uid string, sealed []byte) (string, error) {
+	n := totpCipher.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("could not decrypt totp secret: too short")
+	}
+
+	b, err := totpCipher.Open(nil, sealed[:n], sealed[n:], []byte(uid))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt totp secret: %w", err)
+	}
+
+	return string(b), nil
+}
+
+// validateTOTP checks the code against the periods around t
+// and returns the matching one.
+// Periods up to lastStep were used already and don't count.
+func validateTOTP(secret, code string, t time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	step := t.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		s := step + int64(i)
+		if s <= lastStep {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, s)), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode as defined by RFC 6238.
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, v%mod)
+}
+
+// reserveCodeAttempt counts a code attempt of the user before verifying it,
+// locking the user row so concurrent attempts are counted one after the other.
+// Call it in the same transaction that verifies the code
+// and commit it even when the code is invalid, so the attempt sticks.
+// It returns how long to wait when attempts are locked.
+func reserveCodeAttempt(ctx context.Context, tx *sql.Tx, uid string) (time.Duration, error) {
+	var attempts int
+	var lockedUntil *time.Time
+	var now time.Time
+	if err := tx.QueryRowContext(ctx, `
+		SELECT totp_failed_attempts, totp_locked_until, now() FROM users WHERE id = $1 FOR UPDATE
+	`, uid).Scan(&attempts, &lockedUntil, &now); err != nil {
+		return 0, fmt.Errorf("could not query code attempts: %w", err)
+	}
+
+	if lockedUntil != nil {
+		if lockedUntil.After(now) {
+			return lockedUntil.Sub(now), nil
+		}
+
+		// Lockout over, start again.
+		attempts = 0
+		lockedUntil = nil
+	}
+
+	attempts++
+	if attempts >= maxCodeAttempts {
+		t := now.Add(codeAttemptsLockout)
+		lockedUntil = &t
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users SET totp_failed_attempts = $1, totp_locked_until = $2 WHERE id = $3
+	`, attempts, lockedUntil, uid); err != nil {
+		return 0, fmt.Errorf("could not update code attempts: %w", err)
+	}
+
+	return 0, nil
+}
+
+// codeAttemptsReset after a valid code.
+func codeAttemptsReset(ctx context.Context, tx *sql.Tx, uid string) error {
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users SET totp_failed_attempts = 0, totp_locked_until = NULL WHERE id = $1
+	`, uid); err != nil {
+		return fmt.Errorf("could not reset code attempts: %w", err)
+	}
+
+	return nil
+}
+
+// respondInvalidCode commits the attempt reserved in tx
+// before telling the code was invalid.
+func respondInvalidCode(w http.ResponseWriter, tx *sql.Tx) {
+	if err := tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to count code attempt: %w", err))
+		return
+	}
+
+	respond(w, Errors{map[string]string{
+		"code": "Invalid code",
+	}}, http.StatusUnprocessableEntity)
+}
+
+func respondTooManyCodeAttempts(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	http.Error(w, "Too many code attempts", http.StatusTooManyRequests)
+}
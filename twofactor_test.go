@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTOTPSecret is the SHA-1 seed from RFC 6238.
+var testTOTPSecret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC vectors have 8 digits, the last 6 are the 6 digit code.
+	tt := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "94287082"},
+		{unix: 1111111109, want: "07081804"},
+		{unix: 1234567890, want: "89005924"},
+	}
+
+	for _, tc := range tt {
+		want := tc.want[len(tc.want)-totpDigits:]
+		if got := totpCode([]byte("12345678901234567890"), tc.unix/totpPeriod); got != want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", tc.unix, got, want)
+		}
+
+		step, ok := validateTOTP(testTOTPSecret, want, time.Unix(tc.unix, 0), 0)
+		if !ok || step != tc.unix/totpPeriod {
+			t.Errorf("validateTOTP(T=%d) = %d, %v, want %d, true", tc.unix, step, ok, tc.unix/totpPeriod)
+		}
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+	key, err := totpEncoding.DecodeString(testTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		offset int64
+		want   bool
+	}{
+		{offset: -2, want: false},
+		{offset: -1, want: true},
+		{offset: 0, want: true},
+		{offset: 1, want: true},
+		{offset: 2, want: false},
+	}
+
+	for _, tc := range tt {
+		code := totpCode(key, step+tc.offset)
+		if got, ok := validateTOTP(testTOTPSecret, code, now, 0); ok != tc.want || ok && got != step+tc.offset {
+			t.Errorf("validateTOTP(step%+d) = %d, %v, want %v", tc.offset, got, ok, tc.want)
+		}
+	}
+}
+
+func TestValidateTOTPLastStep(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+	key, err := totpEncoding.DecodeString(testTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := totpCode(key, step)
+
+	if _, ok := validateTOTP(testTOTPSecret, code, now, step); ok {
+		t.Error("code at lastStep accepted")
+	}
+
+	if _, ok := validateTOTP(testTOTPSecret, totpCode(key, step-1), now, step); ok {
+		t.Error("code before lastStep accepted")
+	}
+
+	if _, ok := validateTOTP(testTOTPSecret, code, now, step-1); !ok {
+		t.Error("code after lastStep rejected")
+	}
+}
+
+func TestSealTOTPSecret(t *testing.T) {
+	setupTestTOTPCipher(t)
+
+	sealed, err := sealTOTPSecret("1", testTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(sealed), testTOTPSecret) {
+		t.Error("sealed secret contains the plain secret")
+	}
+
+	got, err := openTOTPSecret("1", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != testTOTPSecret {
+		t.Errorf("openTOTPSecret() = %q, want %q", got, testTOTPSecret)
+	}
+
+	if _, err = openTOTPSecret("2", sealed); err == nil {
+		t.Error("openTOTPSecret() with another user id succeeded")
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tt := []struct {
+		code string
+		want string
+	}{
+		{code: "abcde-12345", want: "abcde12345"},
+		{code: "ABCDE-12345", want: "abcde12345"},
+		{code: " abcde 12345 ", want: "abcde12345"},
+		{code: "AbCdE12345", want: "abcde12345"},
+		{code: "- -", want: ""},
+	}
+
+	for _, tc := range tt {
+		if got := normalizeRecoveryCode(tc.code); got != tc.want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", tc.code, got, tc.want)
+		}
+	}
+}
+
+// TestRecoveryCodeSingleUse needs TEST_DATABASE_URL like TestMagicLink.
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	setupTestDB(t)
+	setupTestTOTPCipher(t)
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is kept.
+	defer func() { _ = tx.Rollback() }()
+
+	uid, err := insertUser(ctx, tx, "recovery_code_test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := sealTOTPSecret(uid, testTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+		UPDATE users SET totp_secret = $1, totp_enabled = true WHERE id = $2
+	`, sealed, uid); err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := insertRecoveryCodes(ctx, tx, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := " " + strings.ToUpper(codes[0]) + " "
+	if ok, err := verifySecondFactor(ctx, tx, uid, code); err != nil || !ok {
+		t.Fatalf("verifySecondFactor(%q) = %v, %v, want true", code, ok, err)
+	}
+
+	if ok, err := verifySecondFactor(ctx, tx, uid, codes[0]); err != nil || ok {
+		t.Errorf("verifySecondFactor() used twice = %v, %v, want false", ok, err)
+	}
+
+	if ok, err := verifySecondFactor(ctx, tx, uid, strings.Replace(codes[1], "-", "", 1)); err != nil || !ok {
+		t.Errorf("verifySecondFactor() another code = %v, %v, want true", ok, err)
+	}
+}
+
+func setupTestTOTPCipher(t *testing.T) {
+	t.Helper()
+
+	var err error
+	if totpCipher, err = newTOTPCipher("testkey"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matryer/way"
+)
+
+const (
+	// typingTimeout is how long a typing signal lasts
+	// unless the client sends another one.
+	typingTimeout = time.Second * 6
+	// typingMinInterval is the minimum time between
+	// two typing signals of the same user.
+	typingMinInterval = time.Second
+)
+
+// TypingSignal sent through the realtime stream
+// when someone starts or stops typing in a conversation.
+type TypingSignal struct {
+	ConversationID string     `json:"conversationId"`
+	User           User       `json:"user"`
+	Typing         bool       `json:"typing"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"`
+}
+
+// eventTypingStop asks every instance to clear a typing state,
+// since it lives in the memory of whichever got the typing signal.
+// It never reaches clients.
+const eventTypingStop = "typing.stop"
+
+// typingStop is the data of eventTypingStop.
+// An empty conversation ID means all of them.
+type typingStop struct {
+	UserID         string `json:"userId"`
+	ConversationID string `json:"conversationId,omitempty"`
+}
+
+type typingKey struct {
+	UserID         string
+	ConversationID string
+}
+
+type typingState struct {
+	user        User
+	receiverIDs []string
+	timer       *time.Timer
+}
+
+// typings holds who is typing where.
+// It lives in memory only and is never persisted.
+var typings = struct {
+	sync.Mutex
+	states     map[typingKey]*typingState
+	lastSignal map[string]time.Time
+}{
+	states:     make(map[typingKey]*typingState),
+	lastSignal: make(map[string]time.Time),
+}
+
+// POST /api/conversations/{conversation_id}/typing
+func startTyping(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	cid := way.Param(ctx, "conversation_id")
+
+	if !allowTypingSignal(uid) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(typingMinInterval.Seconds())))
+		http.Error(w, "Too many typing signals", http.StatusTooManyRequests)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not begin tx: %w", err))
+		return
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	isParticipant, err := queryParticipantExistance(ctx, tx, uid, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query participant existance: %w", err))
+		return
+	}
+
+	if !isParticipant {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	user, err := queryUser(ctx, tx, uid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query auth user: %w", err))
+		return
+	}
+
+	uids, err := queryParticipantIDs(ctx, tx, cid)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query participant ids: %w", err))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondError(w, fmt.Errorf("could not commit tx to start typing: %w", err))
+		return
+	}
+
+	receivers := make([]string, 0, len(uids))
+	for _, id := range uids {
+		if id != uid {
+			receivers = append(receivers, id)
+		}
+	}
+
+	typingStarted(user, cid, receivers)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /api/conversations/{conversation_id}/typing
+func stopTyping(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+	cid := way.Param(ctx, "conversation_id")
+
+	typingStopped(uid, cid)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowTypingSignal rate limits typing signals per user.
+func allowTypingSignal(uid string) bool {
+	now := time.Now()
+
+	typings.Lock()
+	defer typings.Unlock()
+
+	if last, ok := typings.lastSignal[uid]; ok && now.Sub(last) < typingMinInterval {
+		return false
+	}
+
+	typings.lastSignal[uid] = now
+	return true
+}
+
+// typingStarted starts or extends the typing state of the user
+// and lets the other participants know.
+func typingStarted(user User, cid string, receiverIDs []string) {
+	key := typingKey{UserID: user.ID, ConversationID: cid}
+	expiresAt := time.Now().Add(typingTimeout)
+
+	typings.Lock()
+	s, ok := typings.states[key]
+	// If the timer already fired, the state is on its way out;
+	// replace it so the pending expiry doesn't remove the new one.
+	if !ok || !s.timer.Stop() {
+		s = &typingState{}
+		typings.states[key] = s
+		s.timer = time.AfterFunc(typingTimeout, func() {
+			expireTyping(key, s)
+		})
+	} else {
+		s.timer.Reset(typingTimeout)
+	}
+	s.user = user
+	s.receiverIDs = receiverIDs
+	typings.Unlock()
+
+	go broadcast(Event{Name: EventParticipantTyping, Data: TypingSignal{
+		ConversationID: cid,
+		User:           user,
+		Typing:         true,
+		ExpiresAt:      &expiresAt,
+	}, ReceiverIDs: receiverIDs})
+}
+
+// typingStopped clears the typing state of the user in the conversation
+// and lets the other participants know.
+func typingStopped(uid, cid string) {
+	go broadcast(Event{Name: eventTypingStop, Data: typingStop{UserID: uid, ConversationID: cid}})
+}
+
+// typingStoppedEverywhere clears all the typing states of the user.
+// Used when the user has no realtime streams left.
+func typingStoppedEverywhere(uid string) {
+	go broadcast(Event{Name: eventTypingStop, Data: typingStop{UserID: uid}})
+}
+
+// clearTyping runs on every instance when a typing state has to go.
+func clearTyping(stop typingStop) {
+	if stop.ConversationID == "" {
+		clearTypingEverywhere(stop.UserID)
+		return
+	}
+
+	key := typingKey{UserID: stop.UserID, ConversationID: stop.ConversationID}
+
+	typings.Lock()
+	s, ok := typings.states[key]
+	if ok {
+		s.timer.Stop()
+		delete(typings.states, key)
+	}
+	typings.Unlock()
+
+	if ok {
+		typingEnded(key, s)
+	}
+}
+
+func clearTypingEverywhere(uid string) {
+	ended := make(map[typingKey]*typingState)
+
+	typings.Lock()
+	for key, s := range typings.states {
+		if key.UserID == uid {
+			s.timer.Stop()
+			delete(typings.states, key)
+			ended[key] = s
+		}
+	}
+	delete(typings.lastSignal, uid)
+	typings.Unlock()
+
+	for key, s := range ended {
+		typingEnded(key, s)
+	}
+}
+
+func expireTyping(key typingKey, s *typingState) {
+	typings.Lock()
+	current, ok := typings.states[key]
+	ok = ok && current == s
+	if ok {
+		delete(typings.states, key)
+	}
+	typings.Unlock()
+
+	if ok {
+		typingEnded(key, s)
+	}
+}
+
+func typingEnded(key typingKey, s *typingState) {
+	go broadcast(Event{Name: EventParticipantTyping, Data: TypingSignal{
+		ConversationID: key.ConversationID,
+		User:           s.user,
+		Typing:         false,
+	}, ReceiverIDs: s.receiverIDs})
+}
@@ -3,16 +3,27 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // User model.
 type User struct {
-	ID        string  `json:"id"`
-	Username  string  `json:"username"`
-	AvatarURL *string `json:"avatarURL"`
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	AvatarURL *string   `json:"avatarURL"`
+	Presence  *Presence `json:"presence,omitempty"`
+}
+
+// Settings of the auth user.
+type Settings struct {
+	HideLastSeen     bool `json:"hideLastSeen"`
+	TwoFactorEnabled bool `json:"twoFactorEnabled"`
 }
 
 // GET /api/usernames?search={search}
@@ -61,6 +72,58 @@ func searchUsernames(w http.ResponseWriter, r *http.Request) {
 	respond(w, usernames, http.StatusOK)
 }
 
+// GET /api/settings
+func getSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+
+	var s Settings
+	if err := db.QueryRowContext(ctx, `
+		SELECT hide_last_seen, totp_enabled FROM users WHERE id = $1
+	`, uid).Scan(&s.HideLastSeen, &s.TwoFactorEnabled); err != nil {
+		respondError(w, fmt.Errorf("could not query settings: %w", err))
+		return
+	}
+
+	respond(w, s, http.StatusOK)
+}
+
+// PATCH /api/settings
+func updateSettings(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		HideLastSeen *bool `json:"hideLastSeen"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	ctx := r.Context()
+	uid := ctx.Value(keyAuthUserID).(string)
+
+	var s Settings
+	var lastSeenAt *time.Time
+	if err := db.QueryRowContext(ctx, `
+		UPDATE users SET hide_last_seen = COALESCE($1, hide_last_seen)
+		WHERE id = $2
+		RETURNING hide_last_seen, totp_enabled, last_seen_at
+	`, in.HideLastSeen, uid).Scan(&s.HideLastSeen, &s.TwoFactorEnabled, &lastSeenAt); err != nil {
+		respondError(w, fmt.Errorf("could not update settings: %w", err))
+		return
+	}
+
+	if in.HideLastSeen != nil {
+		go func() {
+			if err := lastSeenVisibilityChanged(uid, lastSeenAt, s.HideLastSeen); err != nil {
+				log.Printf("failed to do last seen visibility changed afterwork: %v\n", err)
+			}
+		}()
+	}
+
+	respond(w, s, http.StatusOK)
+}
+
 func queryUser(ctx context.Context, rowQuerier interface {
 	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }, id string) (User, error) {
@@ -78,3 +141,29 @@ func queryUser(ctx context.Context, rowQuerier interface {
 	u.ID = id
 	return u, nil
 }
+
+// insertUser creates a user with the given username,
+// or with a number appended to it if it's taken.
+func insertUser(ctx context.Context, tx *sql.Tx, username string, avatarURL *string) (string, error) {
+	if username == "" {
+		username = "user"
+	}
+
+	candidate := username
+	for i := 2; i <= 100; i++ {
+		var uid string
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO users (username, avatar_url) VALUES ($1, $2)
+			ON CONFLICT (username) DO NOTHING
+			RETURNING id
+		`, candidate, avatarURL).Scan(&uid)
+		if err == sql.ErrNoRows {
+			candidate = username + strconv.Itoa(i)
+			continue
+		}
+
+		return uid, err
+	}
+
+	return "", fmt.Errorf("could not find an available username like %q", username)
+}
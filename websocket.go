@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait      = time.Second * 10
+	wsPongWait       = time.Second * 60
+	wsPingPeriod     = wsPongWait * 9 / 10
+	wsMaxMessageSize = 64 << 10
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// WSEnvelope is the JSON frame exchanged through the WebSocket:
+//
+//	{"id": "1", "type": "send_message", "data": {...}}
+//
+// The server pushes the same events as the SSE stream
+// with the event type as type.
+//
+// Clients can send these commands:
+//
+//	send_message   {"conversationId", "content", "replyToId", "attachmentIds"}
+//	typing         {"conversationId", "typing"}
+//	read_messages  {"conversationId"}
+//
+// Each command is answered with an "ack" frame carrying the same ID
+// and the response body, if any, or an "error" frame with {"status", "error"}.
+type WSEnvelope struct {
+	ID   string          `json:"id,omitempty"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// WSError is the data of an "error" frame.
+type WSError struct {
+	Status int         `json:"status"`
+	Error  interface{} `json:"error"`
+}
+
+// GET /api/ws
+func websocketHandler(router http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		uid := ctx.Value(keyAuthUserID).(string)
+		sid := ctx.Value(keyAuthSessionID).(string)
+
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade already replied with an HTTP error.
+			return
+		}
+
+		defer conn.Close()
+
+		client := registerMessageClient(uid, sid)
+		defer unregisterMessageClient(client)
+
+		replies := make(chan WSEnvelope)
+		done := make(chan struct{})
+		defer close(done)
+
+		// Hijacked connections don't get their context canceled,
+		// so the reader lets the writer know when the client is gone.
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			readWSCommands(conn, router, uid, sid, replies, done)
+		}()
+
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+
+		for {
+			var frame WSEnvelope
+			var isEvent bool
+			var e Event
+			select {
+			case <-ctx.Done():
+				return
+			case <-gone:
+				return
+			case <-client.Closed():
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+					time.Now().Add(wsWriteWait))
+				return
+			case e = <-client.Events:
+				isEvent = true
+				frame.Type = e.Name
+				if frame.Data, err = json.Marshal(e.Data); err != nil {
+					log.Printf("could not marshall event data: %v\n", err)
+					frame.Type = "error"
+					frame.Data, _ = json.Marshal(WSError{
+						Status: http.StatusInternalServerError,
+						Error:  err.Error(),
+					})
+				}
+			case frame = <-replies:
+			case <-ticker.C:
+				_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return
+				}
+				continue
+			}
+
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteJSON(frame); err != nil {
+				return
+			}
+
+			if isEvent {
+				eventSent(e, uid)
+			}
+		}
+	}
+}
+
+// readWSCommands reads client commands until the connection fails
+// and sends back their replies.
+func readWSCommands(conn *websocket.Conn, router http.Handler, uid, sid string, replies chan<- WSEnvelope, done <-chan struct{}) {
+	conn.SetReadLimit(wsMaxMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var cmd WSEnvelope
+		if err := conn.ReadJSON(&cmd); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("could not read websocket command: %v\n", err)
+			}
+			return
+		}
+
+		select {
+		case replies <- runWSCommand(router, uid, sid, cmd):
+		case <-done:
+			return
+		}
+	}
+}
+
+// runWSCommand runs the command through the same HTTP handlers
+// the REST API uses so both transports behave alike.
+// It's authorized with the user and session of the connection
+// since the access token it was opened with expires way before it.
+func runWSCommand(router http.Handler, uid, sid string, cmd WSEnvelope) WSEnvelope {
+	var in struct {
+		ConversationID string `json:"conversationId"`
+		Typing         bool   `json:"typing"`
+	}
+	if err := json.Unmarshal(cmd.Data, &in); err != nil || in.ConversationID == "" {
+		return wsErrorReply(cmd.ID, http.StatusBadRequest, "conversationId required")
+	}
+
+	conversationURL := "/api/conversations/" + url.PathEscape(in.ConversationID)
+
+	var method, path string
+	var body []byte
+	switch cmd.Type {
+	case "send_message":
+		method, path, body = http.MethodPost, conversationURL+"/messages", cmd.Data
+	case "typing":
+		method, path = http.MethodPost, conversationURL+"/typing"
+		if !in.Typing {
+			method = http.MethodDelete
+		}
+	case "read_messages":
+		method, path = http.MethodPost, conversationURL+"/read_messages"
+	default:
+		return wsErrorReply(cmd.ID, http.StatusBadRequest, "Unknown command type")
+	}
+
+	req, err := http.NewRequest(method, path, bytes.NewReader(body))
+	if err != nil {
+		return wsErrorReply(cmd.ID, http.StatusBadRequest, err.Error())
+	}
+
+	ctx := context.WithValue(req.Context(), keyAuthUserID, uid)
+	ctx = context.WithValue(ctx, keyAuthSessionID, sid)
+	req = req.WithContext(ctx)
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res := &wsResponseWriter{header: make(http.Header), status: http.StatusOK}
+	router.ServeHTTP(res, req)
+
+	var data json.RawMessage
+	if b := bytes.TrimSpace(res.body.Bytes()); len(b) != 0 {
+		if json.Valid(b) {
+			data = b
+		} else {
+			data, _ = json.Marshal(string(b))
+		}
+	}
+
+	if res.status >= http.StatusBadRequest {
+		b, _ := json.Marshal(WSError{Status: res.status, Error: data})
+		return WSEnvelope{ID: cmd.ID, Type: "error", Data: b}
+	}
+
+	return WSEnvelope{ID: cmd.ID, Type: "ack", Data: data}
+}
+
+func wsErrorReply(id string, status int, msg string) WSEnvelope {
+	b, _ := json.Marshal(WSError{Status: status, Error: msg})
+	return WSEnvelope{ID: id, Type: "error", Data: b}
+}
+
+// wsResponseWriter records the response of a command.
+type wsResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *wsResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *wsResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *wsResponseWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
+}